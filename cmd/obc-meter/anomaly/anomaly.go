@@ -0,0 +1,179 @@
+// Anomalies are judged against each bucket's own history: the relative change of the new
+// record is compared to the relative changes between the bucket's previous records.
+package anomaly
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/webhook"
+)
+
+const (
+	KindBytesJump        = "bytes_jump"
+	KindBytesDrop        = "bytes_drop"
+	KindBecameEmpty      = "became_empty"
+	KindObjectsExplosion = "objects_explosion"
+)
+
+var Kinds = []string{KindBytesJump, KindBytesDrop, KindBecameEmpty, KindObjectsExplosion}
+
+// records of history used to judge a change
+const historySize = 30
+
+// below this many previous changes the z-score is meaningless and fixed ratios are used instead
+const minChanges = 5
+
+// DetectRunAnomalies checks every record opened by the run and stores (and pushes) the anomalies found
+func DetectRunAnomalies(runId int) ([]db.Anomaly, error) {
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{RunIds: &[]string{strconv.Itoa(runId)}})
+	if err != nil {
+		return nil, err
+	}
+
+	detected := []db.Anomaly{}
+	for _, record := range *records {
+		history, err := db.GetBucketLatestRecords(record.BucketUid, historySize+1)
+		if err != nil {
+			return detected, err
+		}
+
+		for _, anomaly := range detect(record, *history) {
+			anomaly.RunId = runId
+
+			inserted, err := db.InsertAnomaly(anomaly)
+			if err != nil {
+				return detected, err
+			}
+
+			log.Printf("Detected anomaly (%v) [Uid=%v]: %v\n", inserted.Kind, inserted.BucketUid, inserted.Message)
+			detected = append(detected, *inserted)
+
+			webhook.Emit(webhook.TypeAnomaly, "anomalies/"+strconv.Itoa(inserted.ID), inserted, utils.GetConfig().Anomalies.WebhookUrl)
+		}
+	}
+
+	return detected, nil
+}
+
+// history is newest first and starts with record itself
+func detect(record db.Record, history []db.Record) []db.Anomaly {
+	if len(history) < 2 || history[0].ID != record.ID {
+		return nil
+	}
+
+	previous := history[1]
+	anomalies := []db.Anomaly{}
+
+	newAnomaly := func(kind string, score float64, message string) db.Anomaly {
+		return db.Anomaly{
+			BucketUid:            record.BucketUid,
+			RecordId:             record.ID,
+			Kind:                 kind,
+			PreviousObjectsCount: previous.ObjectsCount,
+			PreviousBytesTotal:   previous.BytesTotal,
+			ObjectsCount:         record.ObjectsCount,
+			BytesTotal:           record.BytesTotal,
+			Score:                score,
+			Message:              message,
+		}
+	}
+
+	// changes between consecutive older records, oldest last
+	bytesChanges := []float64{}
+	objectsChanges := []float64{}
+	wasEmpty := false
+	for i := 1; i+1 < len(history); i++ {
+		bytesChanges = append(bytesChanges, relativeChange(history[i+1].BytesTotal, history[i].BytesTotal))
+		objectsChanges = append(objectsChanges, relativeChange(history[i+1].ObjectsCount, history[i].ObjectsCount))
+		if history[i+1].ObjectsCount == 0 {
+			wasEmpty = true
+		}
+	}
+
+	if previous.ObjectsCount > 0 && record.ObjectsCount == 0 {
+		// buckets that are regularly emptied are not anomalous
+		if !wasEmpty {
+			anomalies = append(anomalies, newAnomaly(KindBecameEmpty, 1, fmt.Sprintf("Bucket became empty, it held %v objects (%v bytes)", previous.ObjectsCount, previous.BytesTotal)))
+		}
+
+		return anomalies
+	}
+
+	bytesDelta := math.Abs(float64(record.BytesTotal) - float64(previous.BytesTotal))
+	if bytesDelta >= float64(getMinBytes()) {
+		change := relativeChange(previous.BytesTotal, record.BytesTotal)
+		score, unusual := judge(change, bytesChanges)
+
+		if unusual && change > 0 {
+			anomalies = append(anomalies, newAnomaly(KindBytesJump, score, fmt.Sprintf("Bytes grew from %v to %v (%+.1f%%)", previous.BytesTotal, record.BytesTotal, change*100)))
+		}
+
+		if unusual && change < 0 {
+			anomalies = append(anomalies, newAnomaly(KindBytesDrop, score, fmt.Sprintf("Bytes dropped from %v to %v (%+.1f%%)", previous.BytesTotal, record.BytesTotal, change*100)))
+		}
+	}
+
+	objectsDelta := float64(record.ObjectsCount) - float64(previous.ObjectsCount)
+	if objectsDelta >= float64(getMinObjects()) {
+		change := relativeChange(previous.ObjectsCount, record.ObjectsCount)
+		score, unusual := judge(change, objectsChanges)
+
+		if unusual {
+			anomalies = append(anomalies, newAnomaly(KindObjectsExplosion, score, fmt.Sprintf("Objects grew from %v to %v (%+.1f%%)", previous.ObjectsCount, record.ObjectsCount, change*100)))
+		}
+	}
+
+	return anomalies
+}
+
+// judge scores a change against the previous ones. With enough history the score is the
+// z-score of the change, otherwise the change itself compared to fixed ratios
+// (doubling, or losing half).
+func judge(change float64, changes []float64) (float64, bool) {
+	if len(changes) < minChanges {
+		return change, change >= 1 || change <= -0.5
+	}
+
+	mean := 0.0
+	for _, c := range changes {
+		mean += c
+	}
+	mean /= float64(len(changes))
+
+	variance := 0.0
+	for _, c := range changes {
+		variance += (c - mean) * (c - mean)
+	}
+	// floor keeps buckets that never changed before from flagging every small change
+	stddev := math.Max(math.Sqrt(variance/float64(len(changes))), 0.01)
+
+	// changes smaller than this are never unusual
+	if math.Abs(change-mean) < 0.25 {
+		return 0, false
+	}
+
+	score := (change - mean) / stddev
+	return score, math.Abs(score) >= getZScore()
+}
+
+func relativeChange(from uint64, to uint64) float64 {
+	return (float64(to) - float64(from)) / math.Max(float64(from), 1)
+}
+
+func getZScore() float64 {
+	return utils.GetConfig().Anomalies.ZScore
+}
+
+// changes smaller than this are ignored
+func getMinBytes() uint64 {
+	return utils.GetConfig().Anomalies.MinBytes
+}
+
+func getMinObjects() uint64 {
+	return utils.GetConfig().Anomalies.MinObjects
+}
@@ -3,21 +3,19 @@ package api
 import (
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
 )
 
 func StartServer() {
-	PORT := os.Getenv("PORT")
-
-	if PORT == "" {
-		PORT = "8080"
-	}
+	port := strconv.Itoa(utils.GetConfig().Port)
 
 	server := &http.Server{
-		Addr:    ":" + PORT,
+		Addr:    ":" + port,
 		Handler: getRouter(),
 	}
 
-	log.Printf("Server listening on port %v\n", PORT)
+	log.Printf("Server listening on port %v\n", port)
 	server.ListenAndServe()
 }
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/quota"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	"github.com/gorilla/mux"
+)
+
+type bucketResponse struct {
+	db.Bucket
+	CurrentRecord *db.Record `json:"current_record"`
+	// percentages of maxSize and maxObjects, null without a quota
+	SizeUtilisation    *float64 `json:"size_utilisation"`
+	ObjectsUtilisation *float64 `json:"objects_utilisation"`
+}
+
+func getBuckets(w http.ResponseWriter, r *http.Request) {
+	filters := db.GetBucketsArgs{}
+
+	query := r.URL.Query()
+
+	uids := query.Get("uids")
+	namespaces := query.Get("namespaces")
+	accounts := query.Get("accounts")
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	if namespaces != "" {
+		namespacesList := strings.Split(namespaces, ",")
+		filters.Namespaces = &namespacesList
+	}
+
+	if accounts != "" {
+		accountsList := strings.Split(accounts, ",")
+		filters.Accounts = &accountsList
+	}
+
+	buckets, err := getBucketResponses(filters)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve buckets")
+		return
+	}
+
+	json, err := json.Marshal(buckets)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve buckets")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getBucket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	buckets, err := getBucketResponses(db.GetBucketsArgs{Uids: &[]string{vars["uid"]}})
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve bucket")
+		return
+	}
+
+	if len(buckets) < 1 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Bucket not found")
+		return
+	}
+
+	json, err := json.Marshal(buckets[0])
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse bucket")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getBucketResponses(filters db.GetBucketsArgs) ([]bucketResponse, error) {
+	buckets, err := db.GetBuckets(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := db.GetCurrentRecords(utils.GetConfig().Metering.StaleAfter.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	recordsByUid := map[string]db.Record{}
+	for _, record := range *records {
+		recordsByUid[record.BucketUid] = record
+	}
+
+	responses := []bucketResponse{}
+	for _, bucket := range *buckets {
+		response := bucketResponse{Bucket: bucket}
+
+		record, ok := recordsByUid[bucket.Uid]
+		if ok {
+			response.CurrentRecord = &record
+			response.SizeUtilisation = quota.Utilisation(record.BytesTotal, bucket.MaxSize)
+			response.ObjectsUtilisation = quota.Utilisation(record.ObjectsCount, bucket.MaxObjects)
+		}
+
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
+
+func getQuotaEvents(w http.ResponseWriter, r *http.Request) {
+	filters := db.GetQuotaEventsArgs{}
+
+	query := r.URL.Query()
+
+	uids := query.Get("uids")
+	kinds := query.Get("kinds")
+	open := query.Get("open")
+	from_time := query.Get("from_time")
+	to_time := query.Get("to_time")
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	if kinds != "" {
+		kindsList := strings.Split(kinds, ",")
+		filters.Kinds = &kindsList
+	}
+
+	if open != "" {
+		isOpen := open == "true"
+		filters.Open = &isOpen
+	}
+
+	if from_time != "" {
+		t, err := time.Parse(time.RFC3339, from_time)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'from_time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.FromTime = &t
+	}
+
+	if to_time != "" {
+		t, err := time.Parse(time.RFC3339, to_time)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'to_time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.ToTime = &t
+	}
+
+	events, err := db.GetQuotaEvents(filters)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve quota events")
+		return
+	}
+
+	json, err := json.Marshal(events)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve quota events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
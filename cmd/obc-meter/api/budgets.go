@@ -0,0 +1,321 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/budget"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/pricing"
+	"github.com/gorilla/mux"
+)
+
+type budgetRequest struct {
+	Scope      string  `json:"scope"`
+	ScopeValue string  `json:"scope_value"`
+	Unit       string  `json:"unit"`
+	Amount     float64 `json:"amount"`
+	Period     string  `json:"period"`
+	Thresholds []int   `json:"thresholds"`
+	WebhookUrl *string `json:"webhook_url"`
+}
+
+type budgetResponse struct {
+	db.Budget
+	// null for currency budgets when pricing is not configured
+	Status *budget.Measurement `json:"status"`
+}
+
+func parseBudgetRequest(r *http.Request) (*db.BudgetArgs, error) {
+	var body budgetRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return nil, errors.New("Invalid JSON body")
+	}
+
+	if !slices.Contains(budget.Scopes, body.Scope) {
+		return nil, errors.New("Invalid scope, must be one of " + strings.Join(budget.Scopes, ", "))
+	}
+
+	if body.ScopeValue == "" {
+		return nil, errors.New("Missing scope_value")
+	}
+
+	if !slices.Contains(budget.Units, body.Unit) {
+		return nil, errors.New("Invalid unit, must be one of " + strings.Join(budget.Units, ", "))
+	}
+
+	if body.Unit == budget.UnitCurrency && !pricing.IsConfigured() {
+		return nil, budget.ErrPricingNotConfigured
+	}
+
+	if body.Amount <= 0 {
+		return nil, errors.New("Invalid amount, must be greater than 0")
+	}
+
+	if body.Period == "" {
+		body.Period = budget.PeriodMonthly
+	}
+
+	if !slices.Contains(budget.Periods, body.Period) {
+		return nil, errors.New("Invalid period, must be one of " + strings.Join(budget.Periods, ", "))
+	}
+
+	if len(body.Thresholds) == 0 {
+		body.Thresholds = budget.DefaultThresholds
+	}
+
+	for _, threshold := range body.Thresholds {
+		if threshold <= 0 {
+			return nil, errors.New("Invalid thresholds, must be percentages greater than 0")
+		}
+	}
+
+	slices.Sort(body.Thresholds)
+
+	return &db.BudgetArgs{
+		Scope:      body.Scope,
+		ScopeValue: body.ScopeValue,
+		Unit:       body.Unit,
+		Amount:     body.Amount,
+		Period:     body.Period,
+		Thresholds: slices.Compact(body.Thresholds),
+		WebhookUrl: body.WebhookUrl,
+	}, nil
+}
+
+func getBudgets(w http.ResponseWriter, r *http.Request) {
+	filters := db.GetBudgetsArgs{}
+
+	query := r.URL.Query()
+
+	scope := query.Get("scope")
+	values := query.Get("values")
+
+	if scope != "" {
+		filters.Scope = &scope
+	}
+
+	if values != "" {
+		valuesList := strings.Split(values, ",")
+		filters.Values = &valuesList
+	}
+
+	budgets, err := db.GetBudgets(filters)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve budgets")
+		return
+	}
+
+	json, err := json.Marshal(budgets)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve budgets")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func createBudget(w http.ResponseWriter, r *http.Request) {
+	args, err := parseBudgetRequest(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	created, err := db.CreateBudget(*args)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to create budget")
+		return
+	}
+
+	json, err := json.Marshal(created)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse budget")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	w.Write(json)
+}
+
+func getBudget(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := strconv.Atoi(vars["id"]); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid budget id '%v'\n", vars["id"])
+		return
+	}
+
+	budgets, err := db.GetBudgets(db.GetBudgetsArgs{Ids: &[]string{vars["id"]}})
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve budget")
+		return
+	}
+
+	if len(*budgets) < 1 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Budget not found")
+		return
+	}
+
+	response := budgetResponse{Budget: (*budgets)[0]}
+
+	status, err := budget.Measure(response.Budget, time.Now())
+
+	if err != nil && !errors.Is(err, budget.ErrPricingNotConfigured) {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to measure budget")
+		return
+	}
+
+	response.Status = status
+
+	json, err := json.Marshal(response)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse budget")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func updateBudget(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid budget id '%v'\n", vars["id"])
+		return
+	}
+
+	args, err := parseBudgetRequest(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	updated, err := db.UpdateBudget(id, *args)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to update budget")
+		return
+	}
+
+	if updated == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Budget not found")
+		return
+	}
+
+	json, err := json.Marshal(updated)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse budget")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func deleteBudget(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid budget id '%v'\n", vars["id"])
+		return
+	}
+
+	deleted, err := db.DeleteBudget(id)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to delete budget")
+		return
+	}
+
+	if !deleted {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Budget not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func getBudgetEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid budget id '%v'\n", vars["id"])
+		return
+	}
+
+	events, err := db.GetBudgetEvents(id)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve budget events")
+		return
+	}
+
+	json, err := json.Marshal(events)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve budget events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
@@ -2,17 +2,24 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fallmo/obc-meter/cmd/obc-meter/anomaly"
 	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/focus"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/usage"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
 	"github.com/gorilla/mux"
 )
 
 func getRecords(w http.ResponseWriter, r *http.Request) {
-	filters := db.GetRecordsArgs{}
+	filters := db.GetRecordsArgs{StaleAfter: utils.GetConfig().Metering.StaleAfter.Duration}
 
 	query := r.URL.Query()
 
@@ -20,6 +27,7 @@ func getRecords(w http.ResponseWriter, r *http.Request) {
 	run_ids := query.Get("run_ids")
 	from_period := query.Get("from_period")
 	to_period := query.Get("to_period")
+	step := query.Get("step")
 
 	if uids != "" {
 		uidsList := strings.Split(uids, ",")
@@ -56,6 +64,50 @@ func getRecords(w http.ResponseWriter, r *http.Request) {
 		filters.ToPeriod = &t
 	}
 
+	var stepDuration time.Duration
+	if step != "" {
+		if filters.FromPeriod == nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'from_period' is required when 'step' is set\n")
+			return
+		}
+
+		if filters.ToPeriod == nil {
+			now := time.Now()
+			filters.ToPeriod = &now
+		}
+
+		d, err := parseStep(step, *filters.FromPeriod, *filters.ToPeriod)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'step'. %v\n", err)
+			return
+		}
+
+		stepDuration = d
+	}
+
+	// records are only split at gaps when a fill is requested or they are resampled, otherwise
+	// they are returned as stored with those overlapping gaps flagged
+	fill := query.Get("fill")
+	split := fill != "" || step != ""
+	if fill == "" {
+		fill = utils.GetConfig().Metering.Fill
+	}
+
+	if !slices.Contains(db.Fills, fill) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Failed to parse query parameter 'fill'. It %v\n", db.ErrInvalidFill)
+		return
+	}
+
+	if fill == db.FillInterpolate && step == "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'step' is required when 'fill' is interpolate\n")
+		return
+	}
+
 	records, err := db.GetUsageRecords(filters)
 
 	if err != nil {
@@ -65,15 +117,60 @@ func getRecords(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json, err := json.Marshal(records)
+	estimated, gaps, err := estimateRecords(*records, filters.Uids, filters.FromPeriod, filters.ToPeriod, fill, split)
+	if err != nil && !split {
+		// the records are still valid without their flags
+		fmt.Println(err)
+		estimated = *records
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to analyse gaps")
+		return
+	}
+
+	if step != "" {
+		series := usage.ResampleSteps(estimated, *filters.FromPeriod, *filters.ToPeriod, stepDuration)
+		if fill == db.FillInterpolate {
+			series = usage.InterpolateSteps(series, *records, gaps, stepDuration)
+		}
+		json, _ := json.Marshal(series)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+		return
+	}
+
+	json, err := json.Marshal(estimated)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
 
 }
 
+func getRecordConsistency(w http.ResponseWriter, r *http.Request) {
+	var uids *[]string
+	if r.URL.Query().Get("uids") != "" {
+		uidsList := strings.Split(r.URL.Query().Get("uids"), ",")
+		uids = &uidsList
+	}
+
+	issues, err := db.CheckRecordConsistency(uids)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to check records")
+		return
+	}
+
+	json, _ := json.Marshal(issues)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
 func getBucketRecords(w http.ResponseWriter, r *http.Request) {
-	filters := db.GetBucketRecordsArgs{}
+	filters := db.GetBucketRecordsArgs{StaleAfter: utils.GetConfig().Metering.StaleAfter.Duration}
 	vars := mux.Vars(r)
 	filters.Uid = vars["uid"]
 
@@ -82,6 +179,7 @@ func getBucketRecords(w http.ResponseWriter, r *http.Request) {
 	run_ids := query.Get("run_ids")
 	from_period := query.Get("from_period")
 	to_period := query.Get("to_period")
+	step := query.Get("step")
 
 	if run_ids != "" {
 		runIds := strings.Split(run_ids, ",")
@@ -113,6 +211,50 @@ func getBucketRecords(w http.ResponseWriter, r *http.Request) {
 		filters.ToPeriod = &t
 	}
 
+	var stepDuration time.Duration
+	if step != "" {
+		if filters.FromPeriod == nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'from_period' is required when 'step' is set\n")
+			return
+		}
+
+		if filters.ToPeriod == nil {
+			now := time.Now()
+			filters.ToPeriod = &now
+		}
+
+		d, err := parseStep(step, *filters.FromPeriod, *filters.ToPeriod)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'step'. %v\n", err)
+			return
+		}
+
+		stepDuration = d
+	}
+
+	// records are only split at gaps when a fill is requested or they are resampled, otherwise
+	// they are returned as stored with those overlapping gaps flagged
+	fill := query.Get("fill")
+	split := fill != "" || step != ""
+	if fill == "" {
+		fill = utils.GetConfig().Metering.Fill
+	}
+
+	if !slices.Contains(db.Fills, fill) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Failed to parse query parameter 'fill'. It %v\n", db.ErrInvalidFill)
+		return
+	}
+
+	if fill == db.FillInterpolate && step == "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'step' is required when 'fill' is interpolate\n")
+		return
+	}
+
 	records, err := db.GetBucketUsageRecords(filters)
 
 	if err != nil {
@@ -122,9 +264,33 @@ func getBucketRecords(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	estimated, gaps, err := estimateRecords(*records, &[]string{filters.Uid}, filters.FromPeriod, filters.ToPeriod, fill, split)
+	if err != nil && !split {
+		// the records are still valid without their flags
+		fmt.Println(err)
+		estimated = *records
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to analyse gaps")
+		return
+	}
+
+	if step != "" {
+		series := usage.ResampleSteps(estimated, *filters.FromPeriod, *filters.ToPeriod, stepDuration)
+		if fill == db.FillInterpolate {
+			series = usage.InterpolateSteps(series, *records, gaps, stepDuration)
+		}
+		json, _ := json.Marshal(series)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+		return
+	}
+
 	// w.WriteHeader(200)
 
-	json, err := json.Marshal(records)
+	json, err := json.Marshal(estimated)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
@@ -140,6 +306,7 @@ func getRuns(w http.ResponseWriter, r *http.Request) {
 	trigger := query.Get("trigger")
 	from_time := query.Get("from_time")
 	to_time := query.Get("to_time")
+	statuses := query.Get("statuses")
 
 	if ids != "" {
 		idsList := strings.Split(ids, ",")
@@ -150,6 +317,18 @@ func getRuns(w http.ResponseWriter, r *http.Request) {
 		filters.Trigger = &trigger
 	}
 
+	if statuses != "" {
+		statusesList := strings.Split(statuses, ",")
+		for _, status := range statusesList {
+			if !slices.Contains(db.RunStatuses, status) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid status '%v' in query parameter 'statuses', expected one of %v\n", status, strings.Join(db.RunStatuses, ", "))
+				return
+			}
+		}
+		filters.Statuses = &statusesList
+	}
+
 	if from_time != "" {
 		t, err := time.Parse(time.RFC3339, from_time) // 2006-01-02T15:04:05Z07:00
 		if err != nil {
@@ -233,3 +412,663 @@ func getRun(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
 }
+
+func getFocusExport(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	filters := focus.GetRowsArgs{
+		FromPeriod: time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		ToPeriod:   now,
+		StaleAfter: utils.GetConfig().Metering.StaleAfter.Duration,
+		Fill:       focus.DefaultFill(),
+		Stale:      focus.StaleInclude,
+	}
+
+	query := r.URL.Query()
+
+	uids := query.Get("uids")
+	from_period := query.Get("from_period")
+	to_period := query.Get("to_period")
+	format := query.Get("format")
+	fill := query.Get("fill")
+	stale := query.Get("stale")
+
+	if format == "" {
+		format = "csv"
+	}
+
+	if fill != "" {
+		if !slices.Contains(focus.Fills, fill) {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'fill' must be one of %v\n", strings.Join(focus.Fills, ", "))
+			return
+		}
+		filters.Fill = fill
+	}
+
+	if stale != "" {
+		if !slices.Contains(focus.StaleOptions, stale) {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'stale' must be one of %v\n", strings.Join(focus.StaleOptions, ", "))
+			return
+		}
+		filters.Stale = stale
+	}
+
+	if format != "csv" && format != "parquet" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'format' must be 'csv' or 'parquet'\n")
+		return
+	}
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	if from_period != "" {
+		t, err := time.Parse(time.RFC3339, from_period)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'from_period'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.FromPeriod = t
+	}
+
+	if to_period != "" {
+		t, err := time.Parse(time.RFC3339, to_period)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'to_period'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.ToPeriod = t
+	}
+
+	rows, err := focus.GetRows(filters)
+
+	if errors.Is(err, focus.ErrStaleUsage) {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Refusing to export stale usage (%v)\n", err)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve records")
+		return
+	}
+
+	w.Header().Set("Content-Type", focus.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=\"focus."+format+"\"")
+
+	err = focus.Write(w, format, *rows)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// estimateRecords marks the records that fall in gaps as estimated. Split records are cut at gap
+// boundaries and the fill applied, others are only flagged.
+func estimateRecords(records []db.Record, uids *[]string, from *time.Time, to *time.Time, fill string, split bool) ([]db.Record, []usage.Gap, error) {
+	args := usage.FindGapsArgs{Uids: uids, To: time.Now(), MaxInterval: utils.GetConfig().Metering.StaleAfter.Duration}
+	if from != nil {
+		args.From = *from
+	}
+	if to != nil {
+		args.To = *to
+	}
+
+	gaps, err := usage.FindGaps(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !split {
+		return usage.FlagEstimated(records, gaps, args.To), gaps, nil
+	}
+
+	return usage.MarkEstimated(records, gaps, args.To, fill), gaps, nil
+}
+
+func getGaps(w http.ResponseWriter, r *http.Request) {
+	args := usage.FindGapsArgs{To: time.Now(), MaxInterval: utils.GetConfig().Metering.StaleAfter.Duration}
+
+	query := r.URL.Query()
+
+	uids := query.Get("uids")
+	from_period := query.Get("from_period")
+	to_period := query.Get("to_period")
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		args.Uids = &uidsList
+	}
+
+	if from_period != "" {
+		t, err := time.Parse(time.RFC3339, from_period)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'from_period'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		args.From = t
+	}
+
+	if to_period != "" {
+		t, err := time.Parse(time.RFC3339, to_period)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'to_period'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		args.To = t
+	}
+
+	gaps, err := usage.FindGaps(args)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to analyse gaps")
+		return
+	}
+
+	json, _ := json.Marshal(gaps)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// step is a duration such as 1h or 1d, limited to maxPointsPerSeries steps between from and to
+func parseStep(step string, from time.Time, to time.Time) (time.Duration, error) {
+	d, err := utils.ParseDuration(step)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, errors.New("It must be a positive duration such as 1h or 1d")
+	}
+
+	if to.Sub(from)/d > maxPointsPerSeries {
+		return 0, errors.New("It would return more than 11000 steps per bucket, use a larger step")
+	}
+
+	return d, nil
+}
+
+func getUsageAt(w http.ResponseWriter, r *http.Request) {
+	filters := db.GetUsageAtArgs{StaleAfter: utils.GetConfig().Metering.StaleAfter.Duration}
+
+	query := r.URL.Query()
+
+	at := query.Get("time")
+	uids := query.Get("uids")
+	namespaces := query.Get("namespaces")
+
+	if at == "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'time' is required. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse query parameter 'time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+		return
+	}
+	filters.Time = t
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	if namespaces != "" {
+		namespacesList := strings.Split(namespaces, ",")
+		filters.Namespaces = &namespacesList
+	}
+
+	bucketsUsage, err := db.GetUsageAt(filters)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve usage")
+		return
+	}
+
+	json, err := json.Marshal(bucketsUsage)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getGrowthReport(w http.ResponseWriter, r *http.Request) {
+	args := usage.GrowthReportArgs{
+		To:      time.Now(),
+		GroupBy: "bucket",
+		SortBy:  "bytes",
+		Top:     10,
+	}
+
+	query := r.URL.Query()
+
+	from := query.Get("from")
+	to := query.Get("to")
+	window := query.Get("window")
+	group_by := query.Get("group_by")
+	sort_by := query.Get("sort_by")
+	top := query.Get("top")
+
+	if to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'to'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		args.To = t
+	}
+
+	if from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'from'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		args.From = t
+	} else if window != "" {
+		d, err := utils.ParseDuration(window)
+		if err != nil || d <= 0 {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'window'. It must be a positive duration such as 24h or 7d\n")
+			return
+		}
+
+		args.From = args.To.Add(-d)
+	} else {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Either query parameter 'from' or 'window' is required\n")
+		return
+	}
+
+	if group_by != "" {
+		args.GroupBy = group_by
+	}
+
+	if sort_by != "" {
+		args.SortBy = sort_by
+	}
+
+	if top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'top' must be a positive number, 0 returns every group\n")
+			return
+		}
+
+		args.Top = n
+	}
+
+	if !slices.Contains(usage.GrowthGroupings, args.GroupBy) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'group_by' must be one of %v\n", strings.Join(usage.GrowthGroupings, ", "))
+		return
+	}
+
+	if !slices.Contains(usage.GrowthSortings, args.SortBy) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'sort_by' must be one of %v\n", strings.Join(usage.GrowthSortings, ", "))
+		return
+	}
+
+	report, err := usage.GetGrowthReport(args)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to compute growth report")
+		return
+	}
+
+	json, err := json.Marshal(report)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to compute growth report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getBucketForecast(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	args, ok := parseForecastArgs(w, r)
+	if !ok {
+		return
+	}
+
+	args.Uids = []string{vars["uid"]}
+
+	if r.URL.Query().Get("threshold") == "quota" {
+		buckets, err := db.GetBuckets(db.GetBucketsArgs{Uids: &args.Uids})
+
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to retrieve bucket")
+			return
+		}
+
+		if len(*buckets) < 1 {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Bucket not found")
+			return
+		}
+
+		args.Threshold = getQuotaThreshold(*buckets, args.Metric)
+		if args.Threshold == nil {
+			w.WriteHeader(422)
+			fmt.Fprintf(w, "Bucket has no %v quota\n", args.Metric)
+			return
+		}
+	}
+
+	writeForecast(w, *args)
+}
+
+func getNamespaceForecast(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	args, ok := parseForecastArgs(w, r)
+	if !ok {
+		return
+	}
+
+	buckets, err := db.GetBuckets(db.GetBucketsArgs{Namespaces: &[]string{vars["namespace"]}})
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve buckets")
+		return
+	}
+
+	activeBuckets := []db.Bucket{}
+	for _, bucket := range *buckets {
+		if bucket.DeletedAt == nil {
+			args.Uids = append(args.Uids, bucket.Uid)
+			activeBuckets = append(activeBuckets, bucket)
+		}
+	}
+
+	if len(args.Uids) == 0 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "No metered buckets in namespace '%v'\n", vars["namespace"])
+		return
+	}
+
+	if r.URL.Query().Get("threshold") == "quota" {
+		args.Threshold = getQuotaThreshold(activeBuckets, args.Metric)
+		if args.Threshold == nil {
+			w.WriteHeader(422)
+			fmt.Fprintf(w, "Not every bucket in namespace '%v' has a %v quota\n", vars["namespace"], args.Metric)
+			return
+		}
+	}
+
+	writeForecast(w, *args)
+}
+
+func parseForecastArgs(w http.ResponseWriter, r *http.Request) (*usage.ForecastArgs, bool) {
+	args := usage.ForecastArgs{
+		Uids:    []string{},
+		Metric:  "bytes",
+		Model:   "linear",
+		History: 30 * 24 * time.Hour,
+		Step:    24 * time.Hour,
+		Season:  7 * 24 * time.Hour,
+		Horizon: 365 * 24 * time.Hour,
+	}
+
+	query := r.URL.Query()
+
+	durations := map[string]*time.Duration{
+		"history": &args.History,
+		"step":    &args.Step,
+		"season":  &args.Season,
+		"horizon": &args.Horizon,
+	}
+
+	for name, target := range durations {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		d, err := utils.ParseDuration(query.Get(name))
+		if err != nil || d <= 0 {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter '%v'. It must be a positive duration such as 12h or 30d\n", name)
+			return nil, false
+		}
+
+		*target = d
+	}
+
+	if args.History/args.Step > maxPointsPerSeries || args.Horizon/args.Step > maxPointsPerSeries {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'step' is too small for the history or horizon, use a larger step\n")
+		return nil, false
+	}
+
+	metric := query.Get("metric")
+	model := query.Get("model")
+	at := query.Get("at")
+	threshold := query.Get("threshold")
+
+	if metric != "" {
+		if metric != "bytes" && metric != "objects" {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'metric' must be 'bytes' or 'objects'\n")
+			return nil, false
+		}
+
+		args.Metric = metric
+	}
+
+	if model != "" {
+		if !slices.Contains(usage.ForecastModels, model) {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Query parameter 'model' must be one of %v\n", strings.Join(usage.ForecastModels, ", "))
+			return nil, false
+		}
+
+		args.Model = model
+	}
+
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'at'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return nil, false
+		}
+
+		args.At = &t
+	}
+
+	// "quota" is resolved from the buckets by the caller
+	if threshold != "" && threshold != "quota" {
+		f, err := strconv.ParseFloat(threshold, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'threshold'. It must be a number of bytes or objects\n")
+			return nil, false
+		}
+
+		args.Threshold = &f
+	}
+
+	return &args, true
+}
+
+// sum of the buckets' quotas for the metric, nil unless every bucket has one
+func getQuotaThreshold(buckets []db.Bucket, metric string) *float64 {
+	total := 0.0
+
+	for _, bucket := range buckets {
+		limit := bucket.MaxSize
+		if metric == "objects" {
+			limit = bucket.MaxObjects
+		}
+
+		if limit == nil {
+			return nil
+		}
+
+		total += float64(*limit)
+	}
+
+	return &total
+}
+
+func writeForecast(w http.ResponseWriter, args usage.ForecastArgs) {
+	forecast, err := usage.GetForecast(args)
+
+	if errors.Is(err, usage.ErrNotEnoughHistory) || errors.Is(err, usage.ErrNotEnoughSeasons) {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Failed to compute forecast: %v\n", err)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to compute forecast")
+		return
+	}
+
+	json, err := json.Marshal(forecast)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to compute forecast")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getAnomalies(w http.ResponseWriter, r *http.Request) {
+	filters := db.GetAnomaliesArgs{}
+
+	query := r.URL.Query()
+
+	uids := query.Get("uids")
+	run_ids := query.Get("run_ids")
+	kinds := query.Get("kinds")
+	from_time := query.Get("from_time")
+	to_time := query.Get("to_time")
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	if run_ids != "" {
+		runIds := strings.Split(run_ids, ",")
+		filters.RunIds = &runIds
+	}
+
+	if kinds != "" {
+		kindsList := strings.Split(kinds, ",")
+		for _, kind := range kindsList {
+			if !slices.Contains(anomaly.Kinds, kind) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Unknown anomaly kind '%v', expected one of %v\n", kind, strings.Join(anomaly.Kinds, ", "))
+				return
+			}
+		}
+		filters.Kinds = &kindsList
+	}
+
+	if from_time != "" {
+		t, err := time.Parse(time.RFC3339, from_time)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'from_time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.FromTime = &t
+	}
+
+	if to_time != "" {
+		t, err := time.Parse(time.RFC3339, to_time)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'to_time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.ToTime = &t
+	}
+
+	anomalies, err := db.GetAnomalies(filters)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve anomalies")
+		return
+	}
+
+	json, err := json.Marshal(anomalies)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve anomalies")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
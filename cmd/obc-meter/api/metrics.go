@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+)
+
+// metrics are rendered from the database on every scrape in the Prometheus text format
+
+type metric struct {
+	name   string
+	help   string
+	values []metricValue
+}
+
+type metricValue struct {
+	// name, value pairs
+	labels []string
+	value  float64
+}
+
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := collectMetrics()
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to collect metrics")
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		writeMetric(&buf, m)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func collectMetrics() ([]metric, error) {
+	records, err := db.GetCurrentRecords(utils.GetConfig().Metering.StaleAfter.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := []string{}
+	for _, record := range *records {
+		uids = append(uids, record.BucketUid)
+	}
+
+	buckets, err := db.GetBuckets(db.GetBucketsArgs{Uids: &uids})
+	if err != nil {
+		return nil, err
+	}
+
+	bucketsByUid := map[string]db.Bucket{}
+	for _, bucket := range *buckets {
+		bucketsByUid[bucket.Uid] = bucket
+	}
+
+	bucketBytes := metric{name: "obc_meter_bucket_bytes", help: "Current total size of the objects in a metered bucket."}
+	bucketObjects := metric{name: "obc_meter_bucket_objects", help: "Current number of objects in a metered bucket."}
+	bucketStale := metric{name: "obc_meter_bucket_stale", help: "Whether the current usage of a metered bucket was not verified within the stale period (1) or was (0)."}
+	bucketVerified := metric{name: "obc_meter_bucket_last_verified_timestamp_seconds", help: "Time the current usage of a metered bucket was last verified."}
+
+	for _, record := range *records {
+		bucket := bucketsByUid[record.BucketUid]
+
+		labels := []string{"uid", record.BucketUid, "namespace", bucket.Namespace, "obc_name", bucket.Name, "storage_class", bucket.StorageClass}
+
+		bucketBytes.values = append(bucketBytes.values, newMetricValue(float64(record.BytesTotal), labels...))
+		bucketObjects.values = append(bucketObjects.values, newMetricValue(float64(record.ObjectsCount), labels...))
+
+		stale := 0.0
+		if record.Stale {
+			stale = 1
+		}
+		bucketStale.values = append(bucketStale.values, newMetricValue(stale, labels...))
+
+		if record.LastVerifiedAt != nil {
+			bucketVerified.values = append(bucketVerified.values, newMetricValue(float64(record.LastVerifiedAt.Unix()), labels...))
+		}
+	}
+
+	runDuration := metric{name: "obc_meter_last_run_duration_seconds", help: "Duration of the last finished metering run."}
+	runMetered := metric{name: "obc_meter_last_run_buckets_metered", help: "Number of buckets the last finished metering run attempted."}
+	runFailed := metric{name: "obc_meter_last_run_buckets_failed", help: "Number of buckets the last finished metering run failed to meter."}
+	runFailures := metric{name: "obc_meter_last_run_failures", help: "Number of buckets the last finished metering run failed to meter, by error class."}
+	runEnd := metric{name: "obc_meter_last_run_timestamp_seconds", help: "Time the last metering run finished."}
+	runSuccess := metric{name: "obc_meter_last_successful_run_timestamp_seconds", help: "Time the last metering run without failed buckets finished."}
+
+	lastRun, err := db.GetLatestRun(db.GetLatestRunArgs{})
+	if err != nil {
+		return nil, err
+	}
+
+	if lastRun != nil {
+		runDuration.values = append(runDuration.values, newMetricValue(lastRun.EndTime.Sub(lastRun.StartTime).Seconds()))
+		runMetered.values = append(runMetered.values, newMetricValue(float64(len(lastRun.AllUids))))
+		runFailed.values = append(runFailed.values, newMetricValue(float64(len(lastRun.FailedUids))))
+		runEnd.values = append(runEnd.values, newMetricValue(float64(lastRun.EndTime.Unix())))
+
+		counts, err := db.CountRunErrors(lastRun.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, count := range counts {
+			runFailures.values = append(runFailures.values, newMetricValue(float64(count.Count), "error_class", count.ErrorClass))
+		}
+	}
+
+	lastSuccessfulRun, err := db.GetLatestRun(db.GetLatestRunArgs{Successful: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if lastSuccessfulRun != nil {
+		runSuccess.values = append(runSuccess.values, newMetricValue(float64(lastSuccessfulRun.EndTime.Unix())))
+	}
+
+	return []metric{bucketBytes, bucketObjects, bucketStale, bucketVerified, runDuration, runMetered, runFailed, runFailures, runEnd, runSuccess}, nil
+}
+
+func newMetricValue(value float64, labels ...string) metricValue {
+	return metricValue{labels: labels, value: value}
+}
+
+func writeMetric(buf *bytes.Buffer, m metric) {
+	fmt.Fprintf(buf, "# HELP %v %v\n", m.name, m.help)
+	fmt.Fprintf(buf, "# TYPE %v gauge\n", m.name)
+
+	for _, v := range m.values {
+		buf.WriteString(m.name)
+
+		if len(v.labels) > 0 {
+			pairs := []string{}
+			for i := 0; i+1 < len(v.labels); i += 2 {
+				pairs = append(pairs, v.labels[i]+"=\""+escapeLabelValue(v.labels[i+1])+"\"")
+			}
+			buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+
+		fmt.Fprintf(buf, " %v\n", v.value)
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
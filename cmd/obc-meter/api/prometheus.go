@@ -0,0 +1,321 @@
+package api
+
+// A subset of the Prometheus HTTP API backed by the records table so Grafana can chart
+// usage history that was never scraped. Series use the same names and labels as /metrics.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/prom"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/usage"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	"github.com/gorilla/mux"
+)
+
+// same limit as Prometheus
+const maxPointsPerSeries = 11000
+
+var promMetrics = map[string]usage.ValueFunc{
+	"obc_meter_bucket_bytes":   usage.Bytes,
+	"obc_meter_bucket_objects": usage.Objects,
+}
+
+var promLabelNames = []string{"__name__", "namespace", "obc_name", "storage_class", "uid"}
+
+type promSeries struct {
+	labels  map[string]string
+	records []db.Record
+	value   usage.ValueFunc
+}
+
+type promMatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]interface{}   `json:"values"`
+}
+
+func promQueryRange(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	selector, err := prom.ParseSelector(r.Form.Get("query"))
+	if err != nil {
+		writePromError(w, 400, "bad_data", err.Error())
+		return
+	}
+
+	start, err := parsePromTime(r.Form.Get("start"))
+	if err != nil {
+		writePromError(w, 400, "bad_data", "invalid parameter 'start': "+err.Error())
+		return
+	}
+
+	end, err := parsePromTime(r.Form.Get("end"))
+	if err != nil {
+		writePromError(w, 400, "bad_data", "invalid parameter 'end': "+err.Error())
+		return
+	}
+
+	step, err := parsePromDuration(r.Form.Get("step"))
+	if err != nil || step <= 0 {
+		writePromError(w, 400, "bad_data", "invalid parameter 'step': zero or negative query resolution step widths are not accepted")
+		return
+	}
+
+	if end.Before(start) {
+		writePromError(w, 400, "bad_data", "invalid parameter 'end': end timestamp must not be before start time")
+		return
+	}
+
+	if end.Sub(start)/step > maxPointsPerSeries {
+		writePromError(w, 400, "bad_data", "exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")
+		return
+	}
+
+	// open records are in effect until now, not until the end of the range
+	if end.After(time.Now()) {
+		end = time.Now()
+	}
+
+	series, err := getPromSeries(&start, nil, []prom.Selector{selector})
+	if err != nil {
+		fmt.Println(err)
+		writePromError(w, 500, "internal", "failed to retrieve records")
+		return
+	}
+
+	result := []promMatrixSeries{}
+	for _, s := range series {
+		samples := usage.Resample(s.records, start, end, step, s.value)
+		if len(samples) == 0 {
+			continue
+		}
+
+		values := [][]interface{}{}
+		for _, sample := range samples {
+			values = append(values, []interface{}{
+				float64(sample.Time.UnixMilli()) / 1000,
+				strconv.FormatFloat(sample.Value, 'f', -1, 64),
+			})
+		}
+
+		result = append(result, promMatrixSeries{Metric: s.labels, Values: values})
+	}
+
+	writePromSuccess(w, map[string]interface{}{
+		"resultType": "matrix",
+		"result":     result,
+	})
+}
+
+func promSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	matches := r.Form["match[]"]
+	if len(matches) == 0 {
+		writePromError(w, 400, "bad_data", "no match[] parameter provided")
+		return
+	}
+
+	selectors := []prom.Selector{}
+	for _, match := range matches {
+		selector, err := prom.ParseSelector(match)
+		if err != nil {
+			writePromError(w, 400, "bad_data", err.Error())
+			return
+		}
+		selectors = append(selectors, selector)
+	}
+
+	start, end, err := parsePromRange(r)
+	if err != nil {
+		writePromError(w, 400, "bad_data", err.Error())
+		return
+	}
+
+	series, err := getPromSeries(start, end, selectors)
+	if err != nil {
+		fmt.Println(err)
+		writePromError(w, 500, "internal", "failed to retrieve records")
+		return
+	}
+
+	result := []map[string]string{}
+	for _, s := range series {
+		result = append(result, s.labels)
+	}
+
+	writePromSuccess(w, result)
+}
+
+func promLabels(w http.ResponseWriter, r *http.Request) {
+	writePromSuccess(w, promLabelNames)
+}
+
+func promLabelValues(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := mux.Vars(r)["name"]
+
+	start, end, err := parsePromRange(r)
+	if err != nil {
+		writePromError(w, 400, "bad_data", err.Error())
+		return
+	}
+
+	series, err := getPromSeries(start, end, []prom.Selector{{}})
+	if err != nil {
+		fmt.Println(err)
+		writePromError(w, 500, "internal", "failed to retrieve records")
+		return
+	}
+
+	seen := map[string]bool{}
+	values := []string{}
+	for _, s := range series {
+		value := s.labels[name]
+		if value != "" && !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+
+	writePromSuccess(w, values)
+}
+
+// series selected by any of the selectors, with their records overlapping [start, end]
+func getPromSeries(start *time.Time, end *time.Time, selectors []prom.Selector) ([]promSeries, error) {
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{FromPeriod: start, ToPeriod: end})
+	if err != nil {
+		return nil, err
+	}
+
+	recordsByUid := usage.GroupByBucket(*records)
+
+	uids := []string{}
+	for uid := range recordsByUid {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	buckets, err := db.GetBuckets(db.GetBucketsArgs{Uids: &uids})
+	if err != nil {
+		return nil, err
+	}
+
+	bucketsByUid := map[string]db.Bucket{}
+	for _, bucket := range *buckets {
+		bucketsByUid[bucket.Uid] = bucket
+	}
+
+	metricNames := []string{}
+	for name := range promMetrics {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+
+	series := []promSeries{}
+	for _, name := range metricNames {
+		for _, uid := range uids {
+			bucket := bucketsByUid[uid]
+			labels := map[string]string{
+				"__name__":      name,
+				"uid":           uid,
+				"namespace":     bucket.Namespace,
+				"obc_name":      bucket.Name,
+				"storage_class": bucket.StorageClass,
+			}
+
+			for _, selector := range selectors {
+				if selector.Matches(labels) {
+					series = append(series, promSeries{labels: labels, records: recordsByUid[uid], value: promMetrics[name]})
+					break
+				}
+			}
+		}
+	}
+
+	return series, nil
+}
+
+// start and end are optional on the metadata endpoints
+func parsePromRange(r *http.Request) (*time.Time, *time.Time, error) {
+	var start *time.Time
+	var end *time.Time
+
+	if r.Form.Get("start") != "" {
+		t, err := parsePromTime(r.Form.Get("start"))
+		if err != nil {
+			return nil, nil, errors.New("invalid parameter 'start': " + err.Error())
+		}
+		start = &t
+	}
+
+	if r.Form.Get("end") != "" {
+		t, err := parsePromTime(r.Form.Get("end"))
+		if err != nil {
+			return nil, nil, errors.New("invalid parameter 'end': " + err.Error())
+		}
+		end = &t
+	}
+
+	return start, end, nil
+}
+
+// unix timestamps (with optional decimals) or RFC3339
+func parsePromTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		seconds, fraction := math.Modf(f)
+		return time.Unix(int64(seconds), int64(fraction*1e9)).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, errors.New("cannot parse '" + s + "' to a valid timestamp")
+	}
+
+	return t, nil
+}
+
+// seconds (with optional decimals) or durations such as 5m, 1h, 1d
+func parsePromDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+
+	return utils.ParseDuration(s)
+}
+
+func writePromSuccess(w http.ResponseWriter, data interface{}) {
+	body, err := json.Marshal(map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		writePromError(w, 500, "internal", "failed to encode response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType string, message string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     message,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -14,9 +14,40 @@ func getRouter() *mux.Router {
 	}).Methods("GET")
 
 	router.HandleFunc("/records", getRecords).Methods("GET")
+	router.HandleFunc("/records/consistency", getRecordConsistency).Methods("GET")
 	router.HandleFunc("/records/{uid}", getBucketRecords).Methods("GET")
+	router.HandleFunc("/gaps", getGaps).Methods("GET")
 	router.HandleFunc("/runs", getRuns).Methods("GET")
 	router.HandleFunc("/runs/{id}", getRun).Methods("GET")
+	router.HandleFunc("/runs/{id}", cancelRun).Methods("DELETE")
+	router.HandleFunc("/runs/{id}/events", getRunEvents).Methods("GET")
+	router.HandleFunc("/runs/{id}/buckets", getRunBuckets).Methods("GET")
+	router.HandleFunc("/runs/{id}/retry", retryRun).Methods("POST")
+	router.HandleFunc("/failures", getFailures).Methods("GET")
+	router.HandleFunc("/buckets", getBuckets).Methods("GET")
+	router.HandleFunc("/buckets/{uid}", getBucket).Methods("GET")
+	router.HandleFunc("/buckets/{uid}/runs", getBucketRuns).Methods("GET")
+	router.HandleFunc("/quota-events", getQuotaEvents).Methods("GET")
+	router.HandleFunc("/budgets", getBudgets).Methods("GET")
+	router.HandleFunc("/budgets", createBudget).Methods("POST")
+	router.HandleFunc("/budgets/{id}", getBudget).Methods("GET")
+	router.HandleFunc("/budgets/{id}", updateBudget).Methods("PUT")
+	router.HandleFunc("/budgets/{id}", deleteBudget).Methods("DELETE")
+	router.HandleFunc("/budgets/{id}/events", getBudgetEvents).Methods("GET")
+	router.HandleFunc("/usage/at", getUsageAt).Methods("GET")
+	router.HandleFunc("/reports/growth", getGrowthReport).Methods("GET")
+	router.HandleFunc("/forecast/buckets/{uid}", getBucketForecast).Methods("GET")
+	router.HandleFunc("/forecast/namespaces/{namespace}", getNamespaceForecast).Methods("GET")
+	router.HandleFunc("/anomalies", getAnomalies).Methods("GET")
+	router.HandleFunc("/webhooks/deliveries", getWebhookDeliveries).Methods("GET")
+	router.HandleFunc("/webhooks/deliveries/{id}", getWebhookDelivery).Methods("GET")
+	router.HandleFunc("/webhooks/deliveries/{id}/replay", replayWebhookDelivery).Methods("POST")
+	router.HandleFunc("/export/focus", getFocusExport).Methods("GET")
+	router.HandleFunc("/metrics", getMetrics).Methods("GET")
+	router.HandleFunc("/api/v1/query_range", promQueryRange).Methods("GET", "POST")
+	router.HandleFunc("/api/v1/series", promSeriesHandler).Methods("GET", "POST")
+	router.HandleFunc("/api/v1/labels", promLabels).Methods("GET", "POST")
+	router.HandleFunc("/api/v1/label/{name}/values", promLabelValues).Methods("GET")
 
 	return router
 }
@@ -0,0 +1,332 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/k8s"
+	"github.com/gorilla/mux"
+)
+
+// parseRunBucketFilters reads the 'statuses' and 'error_classes' query parameters, writing the
+// error response when invalid
+func parseRunBucketFilters(w http.ResponseWriter, r *http.Request, filters *db.GetRunBucketsArgs) bool {
+	query := r.URL.Query()
+
+	statuses := query.Get("statuses")
+	error_classes := query.Get("error_classes")
+
+	if statuses != "" {
+		statusesList := strings.Split(statuses, ",")
+		for _, status := range statusesList {
+			if !slices.Contains(db.RunBucketStatuses, status) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid status '%v' in query parameter 'statuses', expected one of %v\n", status, strings.Join(db.RunBucketStatuses, ", "))
+				return false
+			}
+		}
+		filters.Statuses = &statusesList
+	}
+
+	if error_classes != "" {
+		classesList := strings.Split(error_classes, ",")
+		for _, class := range classesList {
+			if !slices.Contains(db.ErrorClasses, class) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid error class '%v' in query parameter 'error_classes', expected one of %v\n", class, strings.Join(db.ErrorClasses, ", "))
+				return false
+			}
+		}
+		filters.ErrorClasses = &classesList
+	}
+
+	return true
+}
+
+func getRunBuckets(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := strconv.Atoi(vars["id"]); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid run id '%v'\n", vars["id"])
+		return
+	}
+
+	filters := db.GetRunBucketsArgs{RunIds: &[]string{vars["id"]}}
+	if !parseRunBucketFilters(w, r, &filters) {
+		return
+	}
+
+	runBuckets, err := db.GetRunBuckets(filters)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve run buckets")
+		return
+	}
+
+	json, _ := json.Marshal(runBuckets)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getBucketRuns(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	filters := db.GetRunBucketsArgs{Uids: &[]string{vars["uid"]}}
+	if !parseRunBucketFilters(w, r, &filters) {
+		return
+	}
+
+	runBuckets, err := db.GetRunBuckets(filters)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve bucket runs")
+		return
+	}
+
+	json, _ := json.Marshal(runBuckets)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// getFailures lists failed buckets across runs, newest runs first
+func getFailures(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filters := db.GetRunBucketsArgs{Statuses: &[]string{db.RunBucketFailed}}
+
+	uids := query.Get("uids")
+	run_ids := query.Get("run_ids")
+
+	if uids != "" {
+		uidsList := strings.Split(uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	if run_ids != "" {
+		runIds := strings.Split(run_ids, ",")
+		filters.RunIds = &runIds
+	}
+
+	if query.Get("statuses") != "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Query parameter 'statuses' is not supported, failures always have status failed\n")
+		return
+	}
+
+	if !parseRunBucketFilters(w, r, &filters) {
+		return
+	}
+
+	runBuckets, err := db.GetRunBuckets(filters)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve failures")
+		return
+	}
+
+	json, _ := json.Marshal(runBuckets)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// retryRun starts a run metering the failed buckets of a finished run again
+func retryRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := strconv.Atoi(vars["id"]); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid run id '%v'\n", vars["id"])
+		return
+	}
+
+	runs, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{vars["id"]}})
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve run")
+		return
+	}
+
+	if len(*runs) < 1 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Run not found")
+		return
+	}
+
+	run := (*runs)[0]
+
+	if run.EndTime == nil {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Run has not finished")
+		return
+	}
+
+	if len(run.FailedUids) == 0 {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Run has no failed buckets")
+		return
+	}
+
+	retryId, err := k8s.RetryRun(run.ID, run.FailedUids)
+	if errors.Is(err, k8s.ErrRunInProgress) {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "A run is in progress, retry when it has finished")
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to start retry run")
+		return
+	}
+
+	retries, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{strconv.Itoa(retryId)}})
+	if err != nil || len(*retries) < 1 {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve retry run")
+		return
+	}
+
+	json, _ := json.Marshal((*retries)[0])
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	w.Write(json)
+}
+
+// cancelRun stops the run in progress, it is closed as cancelled once its buckets being metered
+// are abandoned. Runs in progress on another replica are cancelled at their next heartbeat.
+func cancelRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid run id '%v'\n", vars["id"])
+		return
+	}
+
+	runs, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{vars["id"]}})
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve run")
+		return
+	}
+
+	if len(*runs) < 1 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Run not found")
+		return
+	}
+
+	err = k8s.CancelRun(id)
+	if errors.Is(err, k8s.ErrRunNotActive) {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Run is not in progress")
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to cancel run")
+		return
+	}
+
+	json, _ := json.Marshal((*runs)[0])
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	w.Write(json)
+}
+
+// time between comments keeping idle event streams open through proxies
+const eventStreamKeepAlive = 30 * time.Second
+
+// getRunEvents streams the run's progress as server-sent 'progress' events until it finishes.
+// Runs not in progress get a single event with their last progress.
+func getRunEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid run id '%v'\n", vars["id"])
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Streaming is not supported")
+		return
+	}
+
+	updates, unsubscribe, err := k8s.SubscribeRun(id)
+	if err != nil {
+		runs, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{vars["id"]}})
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to retrieve run")
+			return
+		}
+
+		if len(*runs) < 1 {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Run not found")
+			return
+		}
+
+		finished := make(chan k8s.RunProgress, 1)
+		finished <- k8s.RunProgressOf((*runs)[0])
+		close(finished)
+
+		updates = finished
+		unsubscribe = func() {}
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case progress, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			data, _ := json.Marshal(progress)
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/webhook"
+	"github.com/gorilla/mux"
+)
+
+type webhookDeliveryResponse struct {
+	db.WebhookDelivery
+	Payload json.RawMessage `json:"payload"`
+}
+
+func toWebhookDeliveryResponses(deliveries []db.WebhookDelivery) []webhookDeliveryResponse {
+	responses := []webhookDeliveryResponse{}
+	for _, delivery := range deliveries {
+		responses = append(responses, webhookDeliveryResponse{WebhookDelivery: delivery, Payload: delivery.Payload})
+	}
+
+	return responses
+}
+
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	filters := db.GetWebhookDeliveriesArgs{}
+
+	query := r.URL.Query()
+
+	event_ids := query.Get("event_ids")
+	types := query.Get("types")
+	statuses := query.Get("statuses")
+	from_time := query.Get("from_time")
+	to_time := query.Get("to_time")
+
+	if event_ids != "" {
+		eventIds := strings.Split(event_ids, ",")
+		filters.EventIds = &eventIds
+	}
+
+	if types != "" {
+		typesList := strings.Split(types, ",")
+		for _, eventType := range typesList {
+			if !slices.Contains(webhook.Types, eventType) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Unknown event type '%v', expected one of %v\n", eventType, strings.Join(webhook.Types, ", "))
+				return
+			}
+		}
+		filters.EventTypes = &typesList
+	}
+
+	if statuses != "" {
+		statusesList := strings.Split(statuses, ",")
+		filters.Statuses = &statusesList
+	}
+
+	if from_time != "" {
+		t, err := time.Parse(time.RFC3339, from_time)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'from_time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.FromTime = &t
+	}
+
+	if to_time != "" {
+		t, err := time.Parse(time.RFC3339, to_time)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Println(err)
+			fmt.Fprintf(w, "Failed to parse query parameter 'to_time'. It must be in RFC3339 format (%v)\n", time.Now().Format(time.RFC3339))
+			return
+		}
+
+		filters.ToTime = &t
+	}
+
+	deliveries, err := db.GetWebhookDeliveries(filters)
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	json, err := json.Marshal(toWebhookDeliveryResponses(*deliveries))
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := strconv.Atoi(vars["id"]); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid delivery id '%v'\n", vars["id"])
+		return
+	}
+
+	deliveries, err := db.GetWebhookDeliveries(db.GetWebhookDeliveriesArgs{Ids: &[]string{vars["id"]}})
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve webhook delivery")
+		return
+	}
+
+	if len(*deliveries) < 1 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Webhook delivery not found")
+		return
+	}
+
+	json, err := json.Marshal(toWebhookDeliveryResponses(*deliveries)[0])
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse webhook delivery")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func replayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, err := strconv.Atoi(vars["id"]); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid delivery id '%v'\n", vars["id"])
+		return
+	}
+
+	deliveries, err := db.GetWebhookDeliveries(db.GetWebhookDeliveriesArgs{Ids: &[]string{vars["id"]}})
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to retrieve webhook delivery")
+		return
+	}
+
+	if len(*deliveries) < 1 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Webhook delivery not found")
+		return
+	}
+
+	replay, err := webhook.Replay((*deliveries)[0])
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to replay webhook delivery")
+		return
+	}
+
+	json, err := json.Marshal(toWebhookDeliveryResponses([]db.WebhookDelivery{*replay})[0])
+
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Println(err)
+		fmt.Fprintf(w, "Failed to parse webhook delivery")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	w.Write(json)
+}
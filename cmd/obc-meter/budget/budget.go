@@ -0,0 +1,290 @@
+// Budgets cap the usage of a namespace or an account over a calendar period (UTC), either in
+// bytes stored or, when pricing is configured, in the cost accrued since the period started.
+// Every run measures the budgets and raises an event the first time a threshold is reached
+// (actual) or projected to be reached by the end of the period (forecast).
+package budget
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/pricing"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/usage"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/webhook"
+)
+
+const (
+	ScopeNamespace = "namespace"
+	ScopeAccount   = "account"
+
+	UnitBytes    = "bytes"
+	UnitCurrency = "currency"
+
+	PeriodMonthly = "monthly"
+	PeriodWeekly  = "weekly"
+
+	KindActual   = "actual"
+	KindForecast = "forecast"
+)
+
+var Scopes = []string{ScopeNamespace, ScopeAccount}
+var Units = []string{UnitBytes, UnitCurrency}
+var Periods = []string{PeriodMonthly, PeriodWeekly}
+
+var DefaultThresholds = []int{50, 80, 100}
+
+// PeriodBounds returns the period of the budget that contains t
+func PeriodBounds(period string, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	if period == PeriodWeekly {
+		// weeks start on monday
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	}
+
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+type Measurement struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Unit        string    `json:"unit"`
+	Currency    string    `json:"currency,omitempty"`
+	Amount      float64   `json:"amount"`
+	Actual      float64   `json:"actual"`
+	// percentage of the amount
+	Utilisation float64 `json:"utilisation"`
+	// projected value at the end of the period, nil when there is not enough history
+	Forecast            *float64 `json:"forecast"`
+	ForecastUtilisation *float64 `json:"forecast_utilisation"`
+}
+
+var ErrPricingNotConfigured = errors.New("currency budgets require PRICE_PER_GIB_MONTH to be set")
+
+// Measure computes how much of the budget is used in the period containing now
+func Measure(budget db.Budget, now time.Time) (*Measurement, error) {
+	if budget.Unit == UnitCurrency && !pricing.IsConfigured() {
+		return nil, ErrPricingNotConfigured
+	}
+
+	periodStart, periodEnd := PeriodBounds(budget.Period, now)
+
+	args := db.GetBucketsArgs{}
+	if budget.Scope == ScopeAccount {
+		args.Accounts = &[]string{budget.ScopeValue}
+	} else {
+		args.Namespaces = &[]string{budget.ScopeValue}
+	}
+
+	buckets, err := db.GetBuckets(args)
+	if err != nil {
+		return nil, err
+	}
+
+	measurement := Measurement{
+		PeriodStart: periodStart,
+		PeriodEnd:   periodEnd,
+		Unit:        budget.Unit,
+		Amount:      budget.Amount,
+	}
+
+	if budget.Unit == UnitCurrency {
+		measurement.Currency = pricing.Currency()
+		err = measureCost(&measurement, *buckets, now)
+	} else {
+		err = measureBytes(&measurement, *buckets, now)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if budget.Amount > 0 {
+		measurement.Utilisation = measurement.Actual / budget.Amount * 100
+
+		if measurement.Forecast != nil {
+			forecastUtilisation := *measurement.Forecast / budget.Amount * 100
+			measurement.ForecastUtilisation = &forecastUtilisation
+		}
+	}
+
+	return &measurement, nil
+}
+
+// bytes currently stored, forecast linearly to the end of the period
+func measureBytes(measurement *Measurement, buckets []db.Bucket, now time.Time) error {
+	uids := []string{}
+	for _, bucket := range buckets {
+		if bucket.DeletedAt == nil {
+			uids = append(uids, bucket.Uid)
+		}
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{Uids: &uids, FromPeriod: &now, ToPeriod: &now})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range *records {
+		measurement.Actual += float64(record.BytesTotal)
+	}
+
+	at := measurement.PeriodEnd
+	forecast, err := usage.GetForecast(usage.ForecastArgs{
+		Uids:    uids,
+		Metric:  "bytes",
+		Model:   "linear",
+		History: 30 * 24 * time.Hour,
+		Step:    24 * time.Hour,
+		Horizon: at.Sub(now),
+		At:      &at,
+	})
+	if errors.Is(err, usage.ErrNotEnoughHistory) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if forecast.Prediction != nil {
+		measurement.Forecast = &forecast.Prediction.Value
+	}
+
+	return nil
+}
+
+// cost accrued since the period started, forecast by keeping the current usage until the end of the period
+func measureCost(measurement *Measurement, buckets []db.Bucket, now time.Time) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	uids := []string{}
+	for _, bucket := range buckets {
+		uids = append(uids, bucket.Uid)
+	}
+
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{Uids: &uids, FromPeriod: &measurement.PeriodStart, ToPeriod: &now})
+	if err != nil {
+		return err
+	}
+
+	var currentBytes uint64
+	for _, record := range *records {
+		// periods are clipped to now, open records end now
+		end := *record.PeriodEnd
+		current := !end.Before(now)
+
+		if end.After(record.PeriodStart) {
+			measurement.Actual += pricing.Cost(record.BytesTotal, end.Sub(record.PeriodStart))
+		}
+
+		if current {
+			currentBytes += record.BytesTotal
+		}
+	}
+
+	forecast := measurement.Actual + pricing.Cost(currentBytes, measurement.PeriodEnd.Sub(now))
+	measurement.Forecast = &forecast
+
+	return nil
+}
+
+// EvaluateBudgets measures every budget and stores (and pushes) the events for newly reached thresholds
+func EvaluateBudgets(runId int) ([]db.BudgetEvent, error) {
+	budgets, err := db.GetBudgets(db.GetBudgetsArgs{})
+	if err != nil {
+		return nil, err
+	}
+
+	raised := []db.BudgetEvent{}
+	now := time.Now()
+
+	for _, budget := range *budgets {
+		measurement, err := Measure(budget, now)
+		if errors.Is(err, ErrPricingNotConfigured) {
+			log.Printf("Skipping budget '%v': %v\n", budget.ID, err)
+			continue
+		}
+		if err != nil {
+			return raised, err
+		}
+
+		for _, threshold := range budget.Thresholds {
+			kind := ""
+			value := 0.0
+
+			if measurement.Utilisation >= float64(threshold) {
+				kind = KindActual
+				value = measurement.Actual
+			} else if threshold >= 100 && measurement.ForecastUtilisation != nil && *measurement.ForecastUtilisation >= float64(threshold) {
+				// only overspending is worth forecasting
+				kind = KindForecast
+				value = *measurement.Forecast
+			} else {
+				continue
+			}
+
+			event, err := db.InsertBudgetEvent(db.BudgetEvent{
+				BudgetId:    budget.ID,
+				RunId:       runId,
+				PeriodStart: measurement.PeriodStart,
+				Kind:        kind,
+				Threshold:   threshold,
+				Value:       value,
+				Amount:      budget.Amount,
+			})
+			if err != nil {
+				return raised, err
+			}
+
+			// already raised this period
+			if event == nil {
+				continue
+			}
+
+			log.Printf("Budget '%v' (%v %v) %v %v%% of %v %v\n", budget.ID, budget.Scope, budget.ScopeValue, describe(kind), threshold, budget.Amount, budget.Unit)
+			raised = append(raised, *event)
+
+			notify(budget, *event, *measurement)
+		}
+	}
+
+	return raised, nil
+}
+
+func describe(kind string) string {
+	if kind == KindForecast {
+		return "is projected to reach"
+	}
+
+	return "reached"
+}
+
+type notification struct {
+	Budget      db.Budget      `json:"budget"`
+	Event       db.BudgetEvent `json:"event"`
+	Measurement Measurement    `json:"measurement"`
+}
+
+// the budget's own webhook takes precedence over budgets.webhookUrl
+func notify(budget db.Budget, event db.BudgetEvent, measurement Measurement) {
+	url := utils.GetConfig().Budgets.WebhookUrl
+	if budget.WebhookUrl != nil && *budget.WebhookUrl != "" {
+		url = *budget.WebhookUrl
+	}
+
+	subject := "budgets/" + strconv.Itoa(budget.ID) + "/events/" + strconv.Itoa(event.ID)
+	webhook.Emit(webhook.TypeBudgetEvent, subject, notification{Budget: budget, Event: event, Measurement: measurement}, url)
+}
@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/focus"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+)
+
+const usage = `Usage:
+  obc-meter                 start metering and serve the API
+  obc-meter export focus    write usage as FOCUS rows (see 'obc-meter export focus -h')
+  obc-meter migrate up      apply pending database migrations
+  obc-meter migrate down N  revert the last N database migrations (1 by default)
+  obc-meter migrate status  list database migrations and when they were applied
+`
+
+// Run executes a command given on the command line instead of starting the server
+func Run(args []string) {
+	switch args[0] {
+	case "export":
+		exportCommand(args[1:])
+	case "migrate":
+		migrateCommand(args[1:])
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+}
+
+func exportCommand(args []string) {
+	if len(args) < 1 || args[0] != "focus" {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	now := time.Now().UTC()
+
+	flags := flag.NewFlagSet("export focus", flag.ExitOnError)
+	from := flags.String("from", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339), "start of the export period (RFC3339)")
+	to := flags.String("to", now.Format(time.RFC3339), "end of the export period (RFC3339)")
+	uids := flags.String("uids", "", "comma separated bucket uids to export, all buckets when empty")
+	format := flags.String("format", "csv", "output format, 'csv' or 'parquet'")
+	output := flags.String("output", "", "file to write to, stdout when empty")
+	fill := flags.String("fill", "", "usage within gaps, 'carry_forward' or 'exclude', metering.fill when empty")
+	stale := flags.String("stale", focus.StaleInclude, "stale usage, 'include', 'exclude' or 'refuse' to fail")
+	flags.Parse(args[1:])
+
+	filters := focus.GetRowsArgs{Fill: *fill, Stale: *stale}
+
+	if !slices.Contains(focus.StaleOptions, *stale) {
+		log.Fatalf("Flag 'stale' must be one of %v\n", strings.Join(focus.StaleOptions, ", "))
+	}
+
+	fromPeriod, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("Failed to parse flag 'from'. It must be in RFC3339 format (%v)\n", now.Format(time.RFC3339))
+	}
+	filters.FromPeriod = fromPeriod
+
+	toPeriod, err := time.Parse(time.RFC3339, *to)
+	if err != nil {
+		log.Fatalf("Failed to parse flag 'to'. It must be in RFC3339 format (%v)\n", now.Format(time.RFC3339))
+	}
+	filters.ToPeriod = toPeriod
+
+	if *uids != "" {
+		uidsList := strings.Split(*uids, ",")
+		filters.Uids = &uidsList
+	}
+
+	utils.StartupTasks()
+
+	filters.StaleAfter = utils.GetConfig().Metering.StaleAfter.Duration
+	if filters.Fill == "" {
+		filters.Fill = focus.DefaultFill()
+	}
+
+	if !slices.Contains(focus.Fills, filters.Fill) {
+		log.Fatalf("Flag 'fill' must be one of %v\n", strings.Join(focus.Fills, ", "))
+	}
+
+	rows, err := focus.GetRows(filters)
+	if err != nil {
+		fmt.Println(err)
+		log.Fatal("Failed to retrieve records")
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Println(err)
+			log.Fatalf("Failed to create '%v'\n", *output)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	err = focus.Write(w, *format, *rows)
+	if err != nil {
+		fmt.Println(err)
+		log.Fatal("Failed to write export")
+	}
+}
+
+func migrateCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "up":
+		utils.ConnectDatabase()
+
+		err := db.MigrateUp()
+		if err != nil {
+			fmt.Println(err)
+			log.Fatal("Failed to migrate database")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatalf("Invalid number of migrations '%v'\n", args[1])
+			}
+			steps = n
+		}
+
+		utils.ConnectDatabase()
+
+		err := db.MigrateDown(steps)
+		if err != nil {
+			fmt.Println(err)
+			log.Fatal("Failed to revert migrations")
+		}
+	case "status":
+		utils.ConnectDatabase()
+
+		migrations, err := db.GetMigrations()
+		if err != nil {
+			fmt.Println(err)
+			log.Fatal("Failed to retrieve migrations")
+		}
+
+		for _, migration := range migrations {
+			status := "pending"
+			if migration.AppliedAt != nil {
+				status = "applied " + migration.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-30v %v\n", migration.Version, migration.Name, status)
+		}
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+}
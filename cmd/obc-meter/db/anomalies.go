@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Anomaly struct {
+	ID                   int       `json:"id"`
+	BucketUid            string    `json:"bucket_uid"`
+	RunId                int       `json:"run_id"`
+	RecordId             int       `json:"record_id"`
+	Kind                 string    `json:"kind"`
+	DetectedAt           time.Time `json:"detected_at"`
+	PreviousObjectsCount uint64    `json:"previous_objects_count"`
+	PreviousBytesTotal   uint64    `json:"previous_bytes_count"`
+	ObjectsCount         uint64    `json:"objects_count"`
+	BytesTotal           uint64    `json:"bytes_count"`
+	Score                float64   `json:"score"`
+	Message              string    `json:"message"`
+}
+
+func InsertAnomaly(anomaly Anomaly) (*Anomaly, error) {
+	sql := `INSERT INTO anomalies (bucket_uid, run_id, record_id, kind, previous_objects_count, previous_bytes_total, objects_count, bytes_total, score, message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, detected_at
+	`
+
+	err := pool.QueryRow(
+		context.TODO(),
+		sql,
+		anomaly.BucketUid,
+		anomaly.RunId,
+		anomaly.RecordId,
+		anomaly.Kind,
+		anomaly.PreviousObjectsCount,
+		anomaly.PreviousBytesTotal,
+		anomaly.ObjectsCount,
+		anomaly.BytesTotal,
+		anomaly.Score,
+		anomaly.Message,
+	).Scan(&anomaly.ID, &anomaly.DetectedAt)
+
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &anomaly, nil
+}
+
+type GetAnomaliesArgs struct {
+	Uids     *[]string
+	RunIds   *[]string
+	Kinds    *[]string
+	FromTime *time.Time
+	ToTime   *time.Time
+}
+
+func GetAnomalies(args GetAnomaliesArgs) (*[]Anomaly, error) {
+	whereStatements := []string{}
+	sqlVars := []interface{}{}
+
+	if args.Uids != nil {
+		whereStatements = append(whereStatements, "bucket_uid = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Uids)
+	}
+
+	if args.RunIds != nil {
+		whereStatements = append(whereStatements, "run_id = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.RunIds)
+	}
+
+	if args.Kinds != nil {
+		whereStatements = append(whereStatements, "kind = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Kinds)
+	}
+
+	if args.FromTime != nil {
+		whereStatements = append(whereStatements, "detected_at >= $"+strconv.Itoa(len(whereStatements)+1))
+		sqlVars = append(sqlVars, *args.FromTime)
+	}
+
+	if args.ToTime != nil {
+		whereStatements = append(whereStatements, "detected_at < $"+strconv.Itoa(len(whereStatements)+1))
+		sqlVars = append(sqlVars, *args.ToTime)
+	}
+
+	sql := `
+		SELECT id, bucket_uid, run_id, record_id, kind, detected_at, previous_objects_count, previous_bytes_total, objects_count, bytes_total, score, message
+		FROM anomalies
+		`
+
+	if len(whereStatements) > 0 {
+		sql = sql + "WHERE " + strings.Join(whereStatements, " AND ")
+	}
+
+	sql = sql + " ORDER BY detected_at DESC"
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var anomalies []Anomaly
+	for rows.Next() {
+		var anomaly Anomaly
+		err := rows.Scan(
+			&anomaly.ID,
+			&anomaly.BucketUid,
+			&anomaly.RunId,
+			&anomaly.RecordId,
+			&anomaly.Kind,
+			&anomaly.DetectedAt,
+			&anomaly.PreviousObjectsCount,
+			&anomaly.PreviousBytesTotal,
+			&anomaly.ObjectsCount,
+			&anomaly.BytesTotal,
+			&anomaly.Score,
+			&anomaly.Message,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		anomalies = append(anomalies, anomaly)
+	}
+
+	return &anomalies, nil
+}
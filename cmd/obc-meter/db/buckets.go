@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Bucket struct {
+	Uid          string `json:"uid"`
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	BucketName   string `json:"bucket_name"`
+	StorageClass string `json:"storage_class"`
+	Account      string `json:"account"`
+	// labels of the OBC when it was last seen
+	Labels     map[string]string `json:"labels"`
+	MaxSize    *uint64           `json:"max_size"`
+	MaxObjects *uint64           `json:"max_objects"`
+	CreatedAt  *time.Time        `json:"created_at"`
+	FirstSeen  time.Time         `json:"first_seen"`
+	LastSeen   time.Time         `json:"last_seen"`
+	DeletedAt  *time.Time        `json:"deleted_at"`
+}
+
+type UpsertBucketArgs struct {
+	Uid          string
+	Name         string
+	Namespace    string
+	BucketName   string
+	StorageClass string
+	Account      string
+	Labels       map[string]string
+	MaxSize      *uint64
+	MaxObjects   *uint64
+	CreatedAt    time.Time
+}
+
+// returns true when the bucket was not known before
+func UpsertBucket(args UpsertBucketArgs) (bool, error) {
+	sql := `INSERT INTO buckets (uid, name, namespace, bucket_name, storage_class, account, max_size, max_objects, created_at, labels)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (uid) DO UPDATE
+		SET name = $2, namespace = $3, bucket_name = $4, storage_class = $5, account = $6, max_size = $7, max_objects = $8, created_at = $9, labels = $10,
+			last_seen = NOW(), deleted_at = NULL
+		RETURNING (xmax = 0)
+	`
+
+	labels := args.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	var inserted bool
+	err := pool.QueryRow(
+		context.TODO(),
+		sql,
+		args.Uid,
+		args.Name,
+		args.Namespace,
+		args.BucketName,
+		args.StorageClass,
+		args.Account,
+		args.MaxSize,
+		args.MaxObjects,
+		args.CreatedAt,
+		labels,
+	).Scan(&inserted)
+
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+
+	return inserted, nil
+}
+
+type GetBucketsArgs struct {
+	Uids       *[]string
+	Namespaces *[]string
+	Accounts   *[]string
+}
+
+func GetBuckets(args GetBucketsArgs) (*[]Bucket, error) {
+	whereStatements := []string{}
+	sqlVars := []interface{}{}
+
+	if args.Uids != nil {
+		whereStatements = append(whereStatements, "uid = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Uids)
+	}
+
+	if args.Namespaces != nil {
+		whereStatements = append(whereStatements, "namespace = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Namespaces)
+	}
+
+	if args.Accounts != nil {
+		whereStatements = append(whereStatements, "account = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Accounts)
+	}
+
+	sql := `
+		SELECT uid, name, namespace, bucket_name, storage_class, account, labels, max_size, max_objects, created_at, first_seen, last_seen, deleted_at
+		FROM buckets
+		`
+
+	if len(whereStatements) > 0 {
+		sql = sql + "WHERE " + strings.Join(whereStatements, " AND ")
+	}
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []Bucket
+	for rows.Next() {
+		var bucket Bucket
+		err := rows.Scan(
+			&bucket.Uid,
+			&bucket.Name,
+			&bucket.Namespace,
+			&bucket.BucketName,
+			&bucket.StorageClass,
+			&bucket.Account,
+			&bucket.Labels,
+			&bucket.MaxSize,
+			&bucket.MaxObjects,
+			&bucket.CreatedAt,
+			&bucket.FirstSeen,
+			&bucket.LastSeen,
+			&bucket.DeletedAt,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	return &buckets, nil
+}
+
+// buckets missing from a run's listing were deleted or are no longer selected for metering,
+// their open records are closed at the deletion. Returns the uids of the buckets newly marked
+// as deleted.
+func MarkBucketsDeleted(listedUids []string) ([]string, error) {
+	sql := `WITH deleted AS (
+			UPDATE buckets
+			SET deleted_at = NOW()
+			WHERE deleted_at IS NULL AND NOT (uid = ANY($1))
+			RETURNING uid, deleted_at
+		), closed AS (
+			UPDATE records r
+			SET period_end = GREATEST(r.period_start, d.deleted_at)
+			FROM deleted d
+			WHERE r.bucket_uid = d.uid AND r.period_end IS NULL
+		)
+		SELECT uid FROM deleted
+	`
+
+	rows, err := pool.Query(context.TODO(), sql, listedUids)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	uids := []string{}
+	for rows.Next() {
+		var uid string
+		err := rows.Scan(&uid)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		uids = append(uids, uid)
+	}
+
+	return uids, nil
+}
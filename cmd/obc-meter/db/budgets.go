@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Budget struct {
+	ID int `json:"id"`
+	// namespace or account
+	Scope      string `json:"scope"`
+	ScopeValue string `json:"scope_value"`
+	// bytes or currency
+	Unit   string  `json:"unit"`
+	Amount float64 `json:"amount"`
+	// monthly or weekly
+	Period string `json:"period"`
+	// percentages of the amount that raise an event
+	Thresholds []int     `json:"thresholds"`
+	WebhookUrl *string   `json:"webhook_url"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type BudgetArgs struct {
+	Scope      string
+	ScopeValue string
+	Unit       string
+	Amount     float64
+	Period     string
+	Thresholds []int
+	WebhookUrl *string
+}
+
+func CreateBudget(args BudgetArgs) (*Budget, error) {
+	sql := `INSERT INTO budgets (scope, scope_value, unit, amount, period, thresholds, webhook_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, scope, scope_value, unit, amount, period, thresholds, webhook_url, created_at, updated_at
+	`
+
+	return scanBudget(pool.QueryRow(
+		context.TODO(),
+		sql,
+		args.Scope,
+		args.ScopeValue,
+		args.Unit,
+		args.Amount,
+		args.Period,
+		args.Thresholds,
+		args.WebhookUrl,
+	))
+}
+
+func UpdateBudget(id int, args BudgetArgs) (*Budget, error) {
+	sql := `UPDATE budgets
+		SET scope = $2, scope_value = $3, unit = $4, amount = $5, period = $6, thresholds = $7, webhook_url = $8, updated_at = NOW()
+		WHERE id = $1
+		RETURNING id, scope, scope_value, unit, amount, period, thresholds, webhook_url, created_at, updated_at
+	`
+
+	return scanBudget(pool.QueryRow(
+		context.TODO(),
+		sql,
+		id,
+		args.Scope,
+		args.ScopeValue,
+		args.Unit,
+		args.Amount,
+		args.Period,
+		args.Thresholds,
+		args.WebhookUrl,
+	))
+}
+
+// returns false when the budget does not exist
+func DeleteBudget(id int) (bool, error) {
+	tag, err := pool.Exec(context.TODO(), "DELETE FROM budgets WHERE id = $1", id)
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// nil when there is no row
+func scanBudget(row rowScanner) (*Budget, error) {
+	var budget Budget
+	err := row.Scan(
+		&budget.ID,
+		&budget.Scope,
+		&budget.ScopeValue,
+		&budget.Unit,
+		&budget.Amount,
+		&budget.Period,
+		&budget.Thresholds,
+		&budget.WebhookUrl,
+		&budget.CreatedAt,
+		&budget.UpdatedAt,
+	)
+
+	if err != nil {
+		// not a real error
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &budget, nil
+}
+
+type GetBudgetsArgs struct {
+	Ids    *[]string
+	Scope  *string
+	Values *[]string
+}
+
+func GetBudgets(args GetBudgetsArgs) (*[]Budget, error) {
+	whereStatements := []string{}
+	sqlVars := []interface{}{}
+
+	if args.Ids != nil {
+		whereStatements = append(whereStatements, "id = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Ids)
+	}
+
+	if args.Scope != nil {
+		whereStatements = append(whereStatements, "scope = $"+strconv.Itoa(len(whereStatements)+1))
+		sqlVars = append(sqlVars, *args.Scope)
+	}
+
+	if args.Values != nil {
+		whereStatements = append(whereStatements, "scope_value = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Values)
+	}
+
+	sql := `
+		SELECT id, scope, scope_value, unit, amount, period, thresholds, webhook_url, created_at, updated_at
+		FROM budgets
+		`
+
+	if len(whereStatements) > 0 {
+		sql = sql + "WHERE " + strings.Join(whereStatements, " AND ")
+	}
+
+	sql = sql + " ORDER BY id"
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []Budget
+	for rows.Next() {
+		budget, err := scanBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		budgets = append(budgets, *budget)
+	}
+
+	return &budgets, nil
+}
+
+type BudgetEvent struct {
+	ID          int       `json:"id"`
+	BudgetId    int       `json:"budget_id"`
+	RunId       int       `json:"run_id"`
+	PeriodStart time.Time `json:"period_start"`
+	// actual when the threshold was reached, forecast when it is projected to be reached by the end of the period
+	Kind      string    `json:"kind"`
+	Threshold int       `json:"threshold"`
+	Value     float64   `json:"value"`
+	Amount    float64   `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// returns nil when an event for the same period, kind and threshold already exists
+func InsertBudgetEvent(event BudgetEvent) (*BudgetEvent, error) {
+	sql := `INSERT INTO budget_events (budget_id, run_id, period_start, kind, threshold, value, amount)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (budget_id, period_start, kind, threshold) DO NOTHING
+		RETURNING id, created_at
+	`
+
+	err := pool.QueryRow(
+		context.TODO(),
+		sql,
+		event.BudgetId,
+		event.RunId,
+		event.PeriodStart,
+		event.Kind,
+		event.Threshold,
+		event.Value,
+		event.Amount,
+	).Scan(&event.ID, &event.CreatedAt)
+
+	if err != nil {
+		// not a real error
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+func GetBudgetEvents(budgetId int) (*[]BudgetEvent, error) {
+	sql := `
+		SELECT id, budget_id, run_id, period_start, kind, threshold, value, amount, created_at
+		FROM budget_events
+		WHERE budget_id = $1
+		ORDER BY created_at DESC
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, budgetId)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []BudgetEvent
+	for rows.Next() {
+		var event BudgetEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.BudgetId,
+			&event.RunId,
+			&event.PeriodStart,
+			&event.Kind,
+			&event.Threshold,
+			&event.Value,
+			&event.Amount,
+			&event.CreatedAt,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return &events, nil
+}
@@ -0,0 +1,22 @@
+package db
+
+import (
+	"errors"
+	"strings"
+)
+
+// How usage within gaps, the intervals without a successful observation of a bucket, is
+// reported. Configured by metering.fill and chosen per request.
+
+const (
+	// keep the value of the last observation, what the records store
+	FillCarryForward = "carry_forward"
+	// move linearly from the value before the gap to the value observed after it
+	FillInterpolate = "interpolate"
+	// leave gaps out of the results
+	FillExclude = "exclude"
+)
+
+var Fills = []string{FillCarryForward, FillInterpolate, FillExclude}
+
+var ErrInvalidFill = errors.New("fill must be one of " + strings.Join(Fills, ", "))
@@ -0,0 +1,264 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations are embedded from migrations/<version>_<name>.up.sql and .down.sql, the version
+// being a number. Applied versions are recorded in schema_migrations.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// held while migrating so pods starting together don't race, the value is arbitrary
+const migrationLockId = 7301946
+
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+	up        string
+	down      string
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of obc-meter supports")
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+
+		direction := ""
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration '%v' must end with .up.sql or .down.sql", name)
+		}
+
+		versionPart, rest, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionPart)
+		if !found || err != nil {
+			return nil, fmt.Errorf("migration '%v' must start with a version number", name)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: strings.TrimSuffix(rest, "."+direction+".sql")}
+			byVersion[version] = migration
+		}
+
+		if direction == "up" {
+			migration.up = string(content)
+		} else {
+			migration.down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, migration := range byVersion {
+		if migration.up == "" {
+			return nil, fmt.Errorf("migration %v has no up migration", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// withMigrationLock runs f on a single connection holding the migration advisory lock
+func withMigrationLock(f func(conn *pgxpool.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockId)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", migrationLockId)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+func getAppliedMigrations(conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// MigrateUp applies every pending migration, each in its own transaction. It refuses to
+// run against a schema with versions this binary doesn't know.
+func MigrateUp() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(func(conn *pgxpool.Conn) error {
+		applied, err := getAppliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		latest := migrations[len(migrations)-1].Version
+		for version := range applied {
+			if version > latest {
+				return fmt.Errorf("%w (schema version %v, latest known %v)", ErrSchemaTooNew, version, latest)
+			}
+		}
+
+		for _, migration := range migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			err := runMigration(conn, migration.up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("migration %v_%v failed: %w", migration.Version, migration.Name, err)
+			}
+
+			log.Printf("Applied migration %v_%v\n", migration.Version, migration.Name)
+		}
+
+		return nil
+	})
+}
+
+// MigrateDown reverts the latest steps applied migrations
+func MigrateDown(steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(func(conn *pgxpool.Conn) error {
+		applied, err := getAppliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.down == "" {
+				return fmt.Errorf("migration %v_%v can not be reverted, it has no down migration", migration.Version, migration.Name)
+			}
+
+			err := runMigration(conn, migration.down, "DELETE FROM schema_migrations WHERE version = $1 AND name = $2", migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("reverting migration %v_%v failed: %w", migration.Version, migration.Name, err)
+			}
+
+			log.Printf("Reverted migration %v_%v\n", migration.Version, migration.Name)
+			steps--
+		}
+
+		return nil
+	})
+}
+
+func runMigration(conn *pgxpool.Conn, sql string, bookkeeping string, version int, name string) error {
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, bookkeeping, version, name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetMigrations lists the known migrations with the time they were applied, if they were
+func GetMigrations() ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	err = withMigrationLock(func(conn *pgxpool.Conn) error {
+		applied, err := getAppliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := range migrations {
+			appliedAt, ok := applied[migrations[i].Version]
+			if ok {
+				migrations[i].AppliedAt = &appliedAt
+			}
+		}
+
+		return nil
+	})
+
+	return migrations, err
+}
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS budget_events;
+DROP TABLE IF EXISTS budgets;
+DROP TABLE IF EXISTS quota_events;
+DROP TABLE IF EXISTS anomalies;
+DROP TABLE IF EXISTS buckets;
+DROP TABLE IF EXISTS records;
+DROP TABLE IF EXISTS runs;
@@ -0,0 +1,107 @@
+-- Baseline schema. IF NOT EXISTS lets databases created by hand from the former
+-- sql/records.sql adopt it.
+
+CREATE TABLE IF NOT EXISTS runs (
+    id SERIAL PRIMARY KEY,
+    start_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    end_time TIMESTAMPTZ,
+    trigger TEXT NOT NULL,
+    all_uids TEXT[] NOT NULL,
+    failed_uids TEXT[] NOT NULL,
+    error_messages TEXT[] NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS records (
+    id SERIAL PRIMARY KEY,
+    bucket_uid TEXT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    period_end TIMESTAMPTZ,
+    objects_count BIGINT NOT NULL,
+    bytes_total BIGINT NOT NULL,
+    run_id INT NOT NULL REFERENCES runs(id)
+);
+
+CREATE TABLE IF NOT EXISTS buckets (
+    uid TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    bucket_name TEXT NOT NULL,
+    storage_class TEXT NOT NULL,
+    account TEXT NOT NULL DEFAULT '',
+    max_size BIGINT,
+    max_objects BIGINT,
+    created_at TIMESTAMPTZ,
+    first_seen TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_seen TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    deleted_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS anomalies (
+    id SERIAL PRIMARY KEY,
+    bucket_uid TEXT NOT NULL,
+    run_id INT NOT NULL REFERENCES runs(id),
+    record_id INT NOT NULL REFERENCES records(id),
+    kind TEXT NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    previous_objects_count BIGINT NOT NULL,
+    previous_bytes_total BIGINT NOT NULL,
+    objects_count BIGINT NOT NULL,
+    bytes_total BIGINT NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    message TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS quota_events (
+    id SERIAL PRIMARY KEY,
+    bucket_uid TEXT NOT NULL,
+    run_id INT NOT NULL REFERENCES runs(id),
+    kind TEXT NOT NULL,
+    threshold INT NOT NULL,
+    quota BIGINT NOT NULL,
+    value BIGINT NOT NULL,
+    utilisation DOUBLE PRECISION NOT NULL,
+    raised_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS budgets (
+    id SERIAL PRIMARY KEY,
+    scope TEXT NOT NULL,
+    scope_value TEXT NOT NULL,
+    unit TEXT NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    period TEXT NOT NULL,
+    thresholds INT[] NOT NULL,
+    webhook_url TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS budget_events (
+    id SERIAL PRIMARY KEY,
+    budget_id INT NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+    run_id INT NOT NULL REFERENCES runs(id),
+    period_start TIMESTAMPTZ NOT NULL,
+    kind TEXT NOT NULL,
+    threshold INT NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (budget_id, period_start, kind, threshold)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    url TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    response_status INT,
+    last_error TEXT,
+    replay_of INT REFERENCES webhook_deliveries(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_attempt_at TIMESTAMPTZ,
+    delivered_at TIMESTAMPTZ
+);
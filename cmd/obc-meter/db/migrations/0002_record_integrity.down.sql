@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS records_idempotency_key;
+ALTER TABLE records DROP COLUMN IF EXISTS idempotency_key;
+DROP INDEX IF EXISTS records_one_open_per_bucket;
@@ -0,0 +1,17 @@
+-- Close all but the newest open record of each bucket, earlier races could leave several.
+UPDATE records r
+SET period_end = (
+    SELECT MAX(o.period_start) FROM records o
+    WHERE o.bucket_uid = r.bucket_uid AND o.period_end IS NULL
+)
+WHERE r.period_end IS NULL AND EXISTS (
+    SELECT 1 FROM records o
+    WHERE o.bucket_uid = r.bucket_uid AND o.period_end IS NULL
+    AND (o.period_start, o.id) > (r.period_start, r.id)
+);
+
+CREATE UNIQUE INDEX records_one_open_per_bucket ON records (bucket_uid) WHERE period_end IS NULL;
+
+-- <run id>/<bucket uid>, appending twice with one key returns the first record
+ALTER TABLE records ADD COLUMN idempotency_key TEXT;
+CREATE UNIQUE INDEX records_idempotency_key ON records (idempotency_key);
@@ -0,0 +1,2 @@
+ALTER TABLE records DROP COLUMN IF EXISTS observed_end;
+ALTER TABLE records DROP COLUMN IF EXISTS observed_start;
@@ -0,0 +1,3 @@
+-- when the bucket listing behind a record started and finished, NULL for earlier records
+ALTER TABLE records ADD COLUMN observed_start TIMESTAMPTZ;
+ALTER TABLE records ADD COLUMN observed_end TIMESTAMPTZ;
@@ -0,0 +1,13 @@
+-- one row per successful measurement of a bucket, whether or not its usage changed
+CREATE TABLE observations (
+    id SERIAL PRIMARY KEY,
+    bucket_uid TEXT NOT NULL,
+    run_id INT NOT NULL REFERENCES runs(id),
+    record_id INT NOT NULL REFERENCES records(id),
+    observed_start TIMESTAMPTZ NOT NULL,
+    observed_end TIMESTAMPTZ NOT NULL,
+    UNIQUE (run_id, bucket_uid)
+);
+
+CREATE INDEX observations_record_id ON observations (record_id, observed_end);
+CREATE INDEX observations_bucket_uid ON observations (bucket_uid, observed_end);
@@ -0,0 +1,18 @@
+-- one row per bucket per run, runs.all_uids, failed_uids and error_messages are kept for compatibility
+CREATE TABLE run_buckets (
+    id SERIAL PRIMARY KEY,
+    run_id INT NOT NULL REFERENCES runs(id),
+    bucket_uid TEXT NOT NULL,
+    name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    status TEXT NOT NULL,
+    error_class TEXT,
+    error_message TEXT,
+    duration_ms BIGINT NOT NULL,
+    objects_listed BIGINT NOT NULL,
+    api_calls INT NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (run_id, bucket_uid)
+);
+
+CREATE INDEX run_buckets_bucket_uid ON run_buckets (bucket_uid, run_id);
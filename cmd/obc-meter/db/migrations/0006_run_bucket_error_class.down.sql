@@ -0,0 +1 @@
+DROP INDEX IF EXISTS run_buckets_error_class;
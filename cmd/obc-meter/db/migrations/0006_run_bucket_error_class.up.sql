@@ -0,0 +1 @@
+CREATE INDEX run_buckets_error_class ON run_buckets (error_class, run_id) WHERE error_class IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE run_buckets DROP COLUMN IF EXISTS attempts;
+ALTER TABLE runs DROP COLUMN IF EXISTS retry_of;
@@ -0,0 +1,4 @@
+-- the run whose failed buckets a retry run meters again
+ALTER TABLE runs ADD COLUMN retry_of INT REFERENCES runs(id);
+-- metering attempts made for the bucket within the run
+ALTER TABLE run_buckets ADD COLUMN attempts INT NOT NULL DEFAULT 1;
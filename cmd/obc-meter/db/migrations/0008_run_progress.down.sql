@@ -0,0 +1,5 @@
+ALTER TABLE runs DROP COLUMN IF EXISTS cancelled_at;
+ALTER TABLE runs DROP COLUMN IF EXISTS current_buckets;
+ALTER TABLE runs DROP COLUMN IF EXISTS buckets_failed;
+ALTER TABLE runs DROP COLUMN IF EXISTS buckets_done;
+ALTER TABLE runs DROP COLUMN IF EXISTS buckets_total;
@@ -0,0 +1,10 @@
+ALTER TABLE runs ADD COLUMN buckets_total INT NOT NULL DEFAULT 0;
+ALTER TABLE runs ADD COLUMN buckets_done INT NOT NULL DEFAULT 0;
+ALTER TABLE runs ADD COLUMN buckets_failed INT NOT NULL DEFAULT 0;
+-- namespace/name of the buckets being metered
+ALTER TABLE runs ADD COLUMN current_buckets TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE runs ADD COLUMN cancelled_at TIMESTAMPTZ;
+
+UPDATE runs
+SET buckets_total = cardinality(all_uids), buckets_done = cardinality(all_uids), buckets_failed = cardinality(failed_uids)
+WHERE end_time IS NOT NULL;
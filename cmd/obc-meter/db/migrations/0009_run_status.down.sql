@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS runs_status;
+ALTER TABLE runs DROP COLUMN IF EXISTS heartbeat_at;
+ALTER TABLE runs DROP COLUMN IF EXISTS status;
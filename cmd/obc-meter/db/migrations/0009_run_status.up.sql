@@ -0,0 +1,15 @@
+ALTER TABLE runs ADD COLUMN status TEXT NOT NULL DEFAULT 'running';
+-- refreshed while the run is in progress, runs that stop refreshing it were abandoned
+ALTER TABLE runs ADD COLUMN heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+UPDATE runs
+SET heartbeat_at = COALESCE(end_time, start_time),
+    status = CASE
+        WHEN end_time IS NULL THEN 'running'
+        WHEN cancelled_at IS NOT NULL THEN 'cancelled'
+        WHEN cardinality(failed_uids) = 0 THEN 'succeeded'
+        WHEN cardinality(failed_uids) < cardinality(all_uids) THEN 'partial'
+        ELSE 'failed'
+    END;
+
+CREATE INDEX runs_status ON runs (status, start_time);
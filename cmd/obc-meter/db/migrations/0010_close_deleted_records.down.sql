@@ -0,0 +1 @@
+-- records closed at their bucket's deletion stay closed
@@ -0,0 +1,5 @@
+-- records of deleted buckets used to stay open, close them at the deletion
+UPDATE records r
+SET period_end = GREATEST(r.period_start, b.deleted_at)
+FROM buckets b
+WHERE r.bucket_uid = b.uid AND b.deleted_at IS NOT NULL AND r.period_end IS NULL;
@@ -0,0 +1,6 @@
+-- pending deliveries are attempted again from next_attempt_at, also by other processes after a restart
+ALTER TABLE webhook_deliveries ADD COLUMN next_attempt_at TIMESTAMPTZ;
+
+UPDATE webhook_deliveries SET next_attempt_at = NOW() WHERE status = 'pending';
+
+CREATE INDEX webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,2 @@
+-- labels of the OBC when it was last seen, so selectors still apply once it is deleted
+ALTER TABLE buckets ADD COLUMN labels JSONB NOT NULL DEFAULT '{}';
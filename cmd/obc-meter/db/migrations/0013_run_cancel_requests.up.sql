@@ -0,0 +1,2 @@
+-- cancellations requested from any process, the process running the run checks for them with its heartbeat
+ALTER TABLE runs ADD COLUMN cancel_requested_at TIMESTAMPTZ;
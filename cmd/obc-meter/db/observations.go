@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type Observation struct {
+	ID            int       `json:"id"`
+	BucketUid     string    `json:"bucket_uid"`
+	RunId         int       `json:"run_id"`
+	RecordId      int       `json:"record_id"`
+	ObservedStart time.Time `json:"observed_start"`
+	ObservedEnd   time.Time `json:"observed_end"`
+}
+
+type InsertObservationArgs struct {
+	BucketUid     string
+	RunId         int
+	RecordId      int
+	ObservedStart time.Time
+	ObservedEnd   time.Time
+}
+
+// InsertObservation records a successful measurement, measuring a bucket twice in a run keeps the first
+func InsertObservation(args InsertObservationArgs) error {
+	sql := `
+		INSERT INTO observations (bucket_uid, run_id, record_id, observed_start, observed_end)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (run_id, bucket_uid) DO NOTHING
+		`
+
+	_, err := pool.Exec(context.TODO(), sql, args.BucketUid, args.RunId, args.RecordId, args.ObservedStart, args.ObservedEnd)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+type GetObservationsArgs struct {
+	Uids       *[]string
+	FromPeriod time.Time
+	ToPeriod   time.Time
+}
+
+// GetObservations returns each bucket's observations within the period plus the last one before
+// and the first one after it, ordered by bucket then time. Opening a record counts as an
+// observation, with id 0, over its observed times or at its period start for records from before
+// those were kept.
+func GetObservations(args GetObservationsArgs) ([]Observation, error) {
+	uidFilter := ""
+	sqlVars := []interface{}{args.FromPeriod, args.ToPeriod}
+
+	if args.Uids != nil {
+		uidFilter = "WHERE bucket_uid = ANY($3)"
+		sqlVars = append(sqlVars, *args.Uids)
+	}
+
+	sql := `
+		WITH points AS (
+			SELECT id, bucket_uid, run_id, record_id, observed_start, observed_end
+			FROM observations ` + uidFilter + `
+			UNION ALL
+			SELECT 0, bucket_uid, run_id, id, COALESCE(observed_start, period_start), COALESCE(observed_end, period_start)
+			FROM records ` + uidFilter + `
+		)
+		SELECT * FROM points
+		WHERE observed_end >= $1 AND observed_start < $2
+		UNION ALL
+		SELECT * FROM (
+			SELECT DISTINCT ON (bucket_uid) *
+			FROM points
+			WHERE observed_end < $1
+			ORDER BY bucket_uid, observed_end DESC
+		) before
+		UNION ALL
+		SELECT * FROM (
+			SELECT DISTINCT ON (bucket_uid) *
+			FROM points
+			WHERE observed_start >= $2
+			ORDER BY bucket_uid, observed_start
+		) after
+		ORDER BY bucket_uid, observed_end
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	observations := []Observation{}
+	for rows.Next() {
+		var observation Observation
+		err := rows.Scan(
+			&observation.ID,
+			&observation.BucketUid,
+			&observation.RunId,
+			&observation.RecordId,
+			&observation.ObservedStart,
+			&observation.ObservedEnd,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		observations = append(observations, observation)
+	}
+
+	return observations, rows.Err()
+}
@@ -4,19 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var pool *pgxpool.Pool
 
-func ConnectPostgres() {
-	uri := os.Getenv("POSTGRES_URI")
-	if uri == "" {
-		log.Fatal("Missing 'POSTGRES_URI' environment variable.")
-	}
-
+func ConnectPostgres(uri string) {
 	var err error
 	ctx := context.Background()
 
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type QuotaEvent struct {
+	ID        int    `json:"id"`
+	BucketUid string `json:"bucket_uid"`
+	RunId     int    `json:"run_id"`
+	// size or objects
+	Kind string `json:"kind"`
+	// percentage of the quota
+	Threshold   int        `json:"threshold"`
+	Quota       uint64     `json:"quota"`
+	Value       uint64     `json:"value"`
+	Utilisation float64    `json:"utilisation"`
+	RaisedAt    time.Time  `json:"raised_at"`
+	ResolvedAt  *time.Time `json:"resolved_at"`
+}
+
+func RaiseQuotaEvent(event QuotaEvent) (*QuotaEvent, error) {
+	sql := `INSERT INTO quota_events (bucket_uid, run_id, kind, threshold, quota, value, utilisation)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, raised_at
+	`
+
+	err := pool.QueryRow(
+		context.TODO(),
+		sql,
+		event.BucketUid,
+		event.RunId,
+		event.Kind,
+		event.Threshold,
+		event.Quota,
+		event.Value,
+		event.Utilisation,
+	).Scan(&event.ID, &event.RaisedAt)
+
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// resolves the open events of a bucket above the current utilisation
+func ResolveQuotaEvents(bucketUid string, kind string, utilisation float64) error {
+	sql := `UPDATE quota_events
+		SET resolved_at = NOW()
+		WHERE bucket_uid = $1 AND kind = $2 AND threshold > $3 AND resolved_at IS NULL
+	`
+
+	_, err := pool.Exec(context.TODO(), sql, bucketUid, kind, utilisation)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+type GetQuotaEventsArgs struct {
+	Uids     *[]string
+	Kinds    *[]string
+	Open     *bool
+	FromTime *time.Time
+	ToTime   *time.Time
+}
+
+func GetQuotaEvents(args GetQuotaEventsArgs) (*[]QuotaEvent, error) {
+	whereStatements := []string{}
+	sqlVars := []interface{}{}
+
+	if args.Uids != nil {
+		whereStatements = append(whereStatements, "bucket_uid = ANY($"+strconv.Itoa(len(sqlVars)+1)+")")
+		sqlVars = append(sqlVars, *args.Uids)
+	}
+
+	if args.Kinds != nil {
+		whereStatements = append(whereStatements, "kind = ANY($"+strconv.Itoa(len(sqlVars)+1)+")")
+		sqlVars = append(sqlVars, *args.Kinds)
+	}
+
+	if args.Open != nil {
+		if *args.Open {
+			whereStatements = append(whereStatements, "resolved_at IS NULL")
+		} else {
+			whereStatements = append(whereStatements, "resolved_at IS NOT NULL")
+		}
+	}
+
+	if args.FromTime != nil {
+		whereStatements = append(whereStatements, "raised_at >= $"+strconv.Itoa(len(sqlVars)+1))
+		sqlVars = append(sqlVars, *args.FromTime)
+	}
+
+	if args.ToTime != nil {
+		whereStatements = append(whereStatements, "raised_at < $"+strconv.Itoa(len(sqlVars)+1))
+		sqlVars = append(sqlVars, *args.ToTime)
+	}
+
+	sql := `
+		SELECT id, bucket_uid, run_id, kind, threshold, quota, value, utilisation, raised_at, resolved_at
+		FROM quota_events
+		`
+
+	if len(whereStatements) > 0 {
+		sql = sql + "WHERE " + strings.Join(whereStatements, " AND ")
+	}
+
+	sql = sql + " ORDER BY raised_at DESC"
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []QuotaEvent
+	for rows.Next() {
+		var event QuotaEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.BucketUid,
+			&event.RunId,
+			&event.Kind,
+			&event.Threshold,
+			&event.Quota,
+			&event.Value,
+			&event.Utilisation,
+			&event.RaisedAt,
+			&event.ResolvedAt,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return &events, nil
+}
@@ -2,10 +2,14 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type Record struct {
@@ -16,12 +20,42 @@ type Record struct {
 	ObjectsCount uint64     `json:"objects_count"`
 	BytesTotal   uint64     `json:"bytes_count"`
 	RunId        int        `json:"run_id"`
+	// when the bucket listing behind the record started and finished, the period starts at
+	// observed_start. Unset on records written before listings were timed
+	ObservedStart *time.Time `json:"observed_start"`
+	ObservedEnd   *time.Time `json:"observed_end"`
+	// the latest measurement confirming the record's usage, unset on records older than observations
+	LastVerifiedAt    *time.Time `json:"last_verified_at"`
+	LastVerifiedRunId *int       `json:"last_verified_run_id"`
+	// open and not verified within the stale period, only set when the query asks for it
+	Stale bool `json:"stale"`
+	// the period falls in a gap without observations, or overlaps one when records aren't split
+	// at gaps, only set by gap analysis
+	Estimated bool `json:"estimated"`
+}
+
+// joins the latest observation of each record as last_verified_at and last_verified_run_id
+const lastVerifiedJoin = `LEFT JOIN LATERAL (
+			SELECT o.observed_end AS last_verified_at, o.run_id AS last_verified_run_id
+			FROM observations o
+			WHERE o.record_id = records.id
+			ORDER BY o.observed_end DESC
+			LIMIT 1
+		) verified ON true`
+
+func (record *Record) markStale(staleAfter time.Duration, now time.Time) {
+	if staleAfter <= 0 || record.PeriodEnd != nil {
+		return
+	}
+
+	record.Stale = record.LastVerifiedAt == nil || now.Sub(*record.LastVerifiedAt) > staleAfter
 }
 
+// a bucket has at most one open record, the records_one_open_per_bucket index enforces it
 func GetBucketCurrentRecord(bucketUid string) (*Record, error) {
 	sql := `
-		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id
-		FROM records
+		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id, observed_start, observed_end, last_verified_at, last_verified_run_id
+		FROM records ` + lastVerifiedJoin + `
 		WHERE bucket_uid = $1 AND period_end IS NULL
 		LIMIT 1
 	`
@@ -33,6 +67,10 @@ func GetBucketCurrentRecord(bucketUid string) (*Record, error) {
 	var ObjectsCount uint64
 	var BytesTotal uint64
 	var RunId int
+	var ObservedStart *time.Time
+	var ObservedEnd *time.Time
+	var LastVerifiedAt *time.Time
+	var LastVerifiedRunId *int
 
 	err := pool.QueryRow(context.TODO(), sql, bucketUid).Scan(
 		&ID,
@@ -42,6 +80,10 @@ func GetBucketCurrentRecord(bucketUid string) (*Record, error) {
 		&ObjectsCount,
 		&BytesTotal,
 		&RunId,
+		&ObservedStart,
+		&ObservedEnd,
+		&LastVerifiedAt,
+		&LastVerifiedRunId,
 	)
 
 	if err != nil {
@@ -54,13 +96,17 @@ func GetBucketCurrentRecord(bucketUid string) (*Record, error) {
 	}
 
 	record := Record{
-		ID:           ID,
-		BucketUid:    BucketUid,
-		PeriodStart:  PeriodStart,
-		PeriodEnd:    PeriodEnd,
-		ObjectsCount: ObjectsCount,
-		BytesTotal:   BytesTotal,
-		RunId:        RunId,
+		ID:                ID,
+		BucketUid:         BucketUid,
+		PeriodStart:       PeriodStart,
+		PeriodEnd:         PeriodEnd,
+		ObjectsCount:      ObjectsCount,
+		BytesTotal:        BytesTotal,
+		RunId:             RunId,
+		ObservedStart:     ObservedStart,
+		ObservedEnd:       ObservedEnd,
+		LastVerifiedAt:    LastVerifiedAt,
+		LastVerifiedRunId: LastVerifiedRunId,
 	}
 
 	return &record, nil
@@ -71,61 +117,121 @@ type AppendBucketUsageRecordArgs struct {
 	ObjectsCount uint64
 	BytesTotal   uint64
 	RunId        int
+	// when the bucket listing started and finished
+	ObservedStart time.Time
+	ObservedEnd   time.Time
 }
 
-func AppendBucketUsageRecord(args AppendBucketUsageRecordArgs) (*Record, error) {
+// returned when another transaction opened a record for the bucket at the same time
+var ErrOpenRecordConflict = errors.New("bucket already has an open record")
+
+// AppendBucketUsageRecord closes the bucket's open record and opens a new one at ObservedStart,
+// never before the start of the record it closes. Appends are idempotent per run and bucket,
+// appending again returns the record of the first append and false.
+func AppendBucketUsageRecord(args AppendBucketUsageRecordArgs) (*Record, bool, error) {
 	ctx := context.Background()
 	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, "UPDATE records SET period_end = NOW() WHERE bucket_uid = $1 AND period_end IS NULL", args.BucketUid)
+	// concurrent appends for the bucket wait here until this transaction ends
+	_, err = tx.Exec(ctx, "SELECT id FROM records WHERE bucket_uid = $1 AND period_end IS NULL FOR UPDATE", args.BucketUid)
 	if err != nil {
+		fmt.Println("Failed to lock open record")
+		return nil, false, err
+	}
+
+	idempotencyKey := strconv.Itoa(args.RunId) + "/" + args.BucketUid
+
+	existing := Record{}
+	err = tx.QueryRow(
+		ctx,
+		`SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id, observed_start, observed_end
+		FROM records
+		WHERE idempotency_key = $1`,
+		idempotencyKey,
+	).Scan(
+		&existing.ID,
+		&existing.BucketUid,
+		&existing.PeriodStart,
+		&existing.PeriodEnd,
+		&existing.ObjectsCount,
+		&existing.BytesTotal,
+		&existing.RunId,
+		&existing.ObservedStart,
+		&existing.ObservedEnd,
+	)
+	if err == nil {
+		return &existing, false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		fmt.Println("Failed to look up idempotency key")
+		return nil, false, err
+	}
+
+	// a listing that started before the open record did (overlapping runs) closes it empty
+	periodStart := args.ObservedStart
+	err = tx.QueryRow(
+		ctx,
+		`UPDATE records SET period_end = GREATEST(period_start, $2)
+		WHERE bucket_uid = $1 AND period_end IS NULL
+		RETURNING period_end`,
+		args.BucketUid,
+		args.ObservedStart,
+	).Scan(&periodStart)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		fmt.Println("Failed to close previous records")
-		tx.Rollback(ctx)
-		return nil, err
+		return nil, false, err
 	}
 
 	var id int
-	var period_start time.Time
 
 	err = tx.QueryRow(
 		ctx,
-		`INSERT INTO records (bucket_uid, objects_count, bytes_total, run_id)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, period_start`,
+		`INSERT INTO records (bucket_uid, period_start, objects_count, bytes_total, run_id, idempotency_key, observed_start, observed_end)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
 		args.BucketUid,
+		periodStart,
 		args.ObjectsCount,
 		args.BytesTotal,
 		args.RunId,
-	).Scan(&id, &period_start)
+		idempotencyKey,
+		args.ObservedStart,
+		args.ObservedEnd,
+	).Scan(&id)
 
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.ConstraintName == "records_one_open_per_bucket" {
+			return nil, false, ErrOpenRecordConflict
+		}
+
 		fmt.Println("Failed to insert new record")
-		tx.Rollback(ctx)
-		return nil, err
+		return nil, false, err
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
 		fmt.Println("Failed to commit transaction")
-		tx.Rollback(ctx)
-		return nil, err
+		return nil, false, err
 	}
 
 	record := Record{
-		ID:           id,
-		BucketUid:    args.BucketUid,
-		PeriodStart:  period_start,
-		PeriodEnd:    nil,
-		ObjectsCount: args.ObjectsCount,
-		BytesTotal:   args.BytesTotal,
-		RunId:        args.RunId,
+		ID:            id,
+		BucketUid:     args.BucketUid,
+		PeriodStart:   periodStart,
+		PeriodEnd:     nil,
+		ObjectsCount:  args.ObjectsCount,
+		BytesTotal:    args.BytesTotal,
+		RunId:         args.RunId,
+		ObservedStart: &args.ObservedStart,
+		ObservedEnd:   &args.ObservedEnd,
 	}
 
-	return &record, nil
+	return &record, true, nil
 }
 
 type GetRecordsArgs struct {
@@ -133,6 +239,8 @@ type GetRecordsArgs struct {
 	FromPeriod *time.Time
 	ToPeriod   *time.Time
 	RunIds     *[]string
+	// open records not verified for this long are marked stale, never when zero
+	StaleAfter time.Duration
 }
 
 func GetUsageRecords(args GetRecordsArgs) (*[]Record, error) {
@@ -160,8 +268,8 @@ func GetUsageRecords(args GetRecordsArgs) (*[]Record, error) {
 	}
 
 	sql := `
-		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id
-		FROM records
+		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id, observed_start, observed_end, last_verified_at, last_verified_run_id
+		FROM records ` + lastVerifiedJoin + `
 		`
 
 	if len(whereStatements) > 0 {
@@ -176,6 +284,7 @@ func GetUsageRecords(args GetRecordsArgs) (*[]Record, error) {
 		return nil, err
 	}
 
+	now := time.Now()
 	var records []Record
 	for rows.Next() {
 		var record Record
@@ -187,6 +296,10 @@ func GetUsageRecords(args GetRecordsArgs) (*[]Record, error) {
 			&record.ObjectsCount,
 			&record.BytesTotal,
 			&record.RunId,
+			&record.ObservedStart,
+			&record.ObservedEnd,
+			&record.LastVerifiedAt,
+			&record.LastVerifiedRunId,
 		)
 
 		if err != nil {
@@ -194,6 +307,8 @@ func GetUsageRecords(args GetRecordsArgs) (*[]Record, error) {
 			return nil, err
 		}
 
+		record.markStale(args.StaleAfter, now)
+
 		if args.FromPeriod != nil && record.PeriodStart.Before(*args.FromPeriod) {
 			record.PeriodStart = *args.FromPeriod
 		}
@@ -208,11 +323,48 @@ func GetUsageRecords(args GetRecordsArgs) (*[]Record, error) {
 	return &records, nil
 }
 
+// GetLastRecordEnds returns when the last record of each bucket ended, buckets whose last record
+// is still open are left out
+func GetLastRecordEnds(uids []string) (map[string]time.Time, error) {
+	sql := `
+		SELECT bucket_uid, period_end FROM (
+			SELECT DISTINCT ON (bucket_uid) bucket_uid, period_end
+			FROM records
+			WHERE bucket_uid = ANY($1)
+			ORDER BY bucket_uid, period_start DESC, id DESC
+		) last
+		WHERE period_end IS NOT NULL
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, uids)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ends := map[string]time.Time{}
+	for rows.Next() {
+		var uid string
+		var end time.Time
+		err := rows.Scan(&uid, &end)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		ends[uid] = end
+	}
+
+	return ends, rows.Err()
+}
+
 type GetBucketRecordsArgs struct {
 	Uid        string
 	FromPeriod *time.Time
 	ToPeriod   *time.Time
 	RunIds     *[]string
+	// open records not verified for this long are marked stale, never when zero
+	StaleAfter time.Duration
 }
 
 // redundant code, GetUsageRecords covers function
@@ -237,8 +389,8 @@ func GetBucketUsageRecords(args GetBucketRecordsArgs) (*[]Record, error) {
 	}
 
 	sql := `
-		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id
-		FROM records
+		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id, observed_start, observed_end, last_verified_at, last_verified_run_id
+		FROM records ` + lastVerifiedJoin + `
 		` + strings.Join(whereStatements, " AND ")
 
 	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
@@ -249,6 +401,7 @@ func GetBucketUsageRecords(args GetBucketRecordsArgs) (*[]Record, error) {
 		return nil, err
 	}
 
+	now := time.Now()
 	var records []Record
 	for rows.Next() {
 		var record Record
@@ -260,6 +413,10 @@ func GetBucketUsageRecords(args GetBucketRecordsArgs) (*[]Record, error) {
 			&record.ObjectsCount,
 			&record.BytesTotal,
 			&record.RunId,
+			&record.ObservedStart,
+			&record.ObservedEnd,
+			&record.LastVerifiedAt,
+			&record.LastVerifiedRunId,
 		)
 
 		if err != nil {
@@ -267,6 +424,8 @@ func GetBucketUsageRecords(args GetBucketRecordsArgs) (*[]Record, error) {
 			return nil, err
 		}
 
+		record.markStale(args.StaleAfter, now)
+
 		if args.FromPeriod != nil && record.PeriodStart.Before(*args.FromPeriod) {
 			record.PeriodStart = *args.FromPeriod
 		}
@@ -280,3 +439,205 @@ func GetBucketUsageRecords(args GetBucketRecordsArgs) (*[]Record, error) {
 
 	return &records, nil
 }
+
+// open records hold the current usage of every metered bucket, those not verified for staleAfter
+// are marked stale (never when zero)
+func GetCurrentRecords(staleAfter time.Duration) (*[]Record, error) {
+	sql := `
+		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id, observed_start, observed_end, last_verified_at, last_verified_run_id
+		FROM records ` + lastVerifiedJoin + `
+		WHERE period_end IS NULL
+		`
+
+	rows, err := pool.Query(context.TODO(), sql)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var records []Record
+	for rows.Next() {
+		var record Record
+		err := rows.Scan(
+			&record.ID,
+			&record.BucketUid,
+			&record.PeriodStart,
+			&record.PeriodEnd,
+			&record.ObjectsCount,
+			&record.BytesTotal,
+			&record.RunId,
+			&record.ObservedStart,
+			&record.ObservedEnd,
+			&record.LastVerifiedAt,
+			&record.LastVerifiedRunId,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		record.markStale(staleAfter, now)
+		records = append(records, record)
+	}
+
+	return &records, nil
+}
+
+// latest records of a bucket, newest first
+func GetBucketLatestRecords(bucketUid string, limit int) (*[]Record, error) {
+	sql := `
+		SELECT id, bucket_uid, period_start, period_end, objects_count, bytes_total, run_id, observed_start, observed_end, last_verified_at, last_verified_run_id
+		FROM records ` + lastVerifiedJoin + `
+		WHERE bucket_uid = $1
+		ORDER BY period_start DESC
+		LIMIT $2
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, bucketUid, limit)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var record Record
+		err := rows.Scan(
+			&record.ID,
+			&record.BucketUid,
+			&record.PeriodStart,
+			&record.PeriodEnd,
+			&record.ObjectsCount,
+			&record.BytesTotal,
+			&record.RunId,
+			&record.ObservedStart,
+			&record.ObservedEnd,
+			&record.LastVerifiedAt,
+			&record.LastVerifiedRunId,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return &records, nil
+}
+
+// deletes the records closed before the cutoff along with their anomalies and observations, returns the number of records deleted
+func DeleteRecordsBefore(cutoff time.Time) (int64, error) {
+	ctx := context.Background()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "DELETE FROM anomalies WHERE record_id IN (SELECT id FROM records WHERE period_end < $1)", cutoff)
+	if err != nil {
+		fmt.Println("Failed to delete anomalies")
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM observations WHERE record_id IN (SELECT id FROM records WHERE period_end < $1)", cutoff)
+	if err != nil {
+		fmt.Println("Failed to delete observations")
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, "DELETE FROM records WHERE period_end < $1", cutoff)
+	if err != nil {
+		fmt.Println("Failed to delete records")
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		fmt.Println("Failed to commit transaction")
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+const (
+	IssueOverlap = "overlap"
+	IssueGap     = "gap"
+)
+
+// RecordIssue is a break in a bucket's timeline: a record starting before the previous one
+// ended (or while it is still open), or after it ended
+type RecordIssue struct {
+	BucketUid         string     `json:"bucket_uid"`
+	Kind              string     `json:"kind"`
+	RecordId          int        `json:"record_id"`
+	PeriodStart       time.Time  `json:"period_start"`
+	PreviousRecordId  int        `json:"previous_record_id"`
+	PreviousPeriodEnd *time.Time `json:"previous_period_end"`
+}
+
+// CheckRecordConsistency compares each record with the bucket's previous record, periods are
+// expected to follow each other without overlaps or gaps
+func CheckRecordConsistency(uids *[]string) ([]RecordIssue, error) {
+	where := ""
+	sqlVars := []interface{}{}
+
+	if uids != nil {
+		where = "WHERE bucket_uid = ANY($1)"
+		sqlVars = append(sqlVars, *uids)
+	}
+
+	sql := `
+		SELECT bucket_uid, id, period_start, previous_id, previous_end
+		FROM (
+			SELECT bucket_uid, id, period_start,
+				LAG(id) OVER timeline AS previous_id,
+				LAG(period_end) OVER timeline AS previous_end
+			FROM records
+			` + where + `
+			WINDOW timeline AS (PARTITION BY bucket_uid ORDER BY period_start, id)
+		) t
+		WHERE previous_id IS NOT NULL AND (previous_end IS NULL OR previous_end <> period_start)
+		ORDER BY bucket_uid, period_start
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	issues := []RecordIssue{}
+	for rows.Next() {
+		var issue RecordIssue
+		err := rows.Scan(
+			&issue.BucketUid,
+			&issue.RecordId,
+			&issue.PeriodStart,
+			&issue.PreviousRecordId,
+			&issue.PreviousPeriodEnd,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		issue.Kind = IssueGap
+		if issue.PreviousPeriodEnd == nil || issue.PreviousPeriodEnd.After(issue.PeriodStart) {
+			issue.Kind = IssueOverlap
+		}
+
+		issues = append(issues, issue)
+	}
+
+	return issues, rows.Err()
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RunBucketUpdated   = "updated"
+	RunBucketUnchanged = "unchanged"
+	RunBucketFailed    = "failed"
+	// metering is disabled for the bucket's storage class
+	RunBucketSkipped = "skipped"
+)
+
+var RunBucketStatuses = []string{RunBucketUpdated, RunBucketUnchanged, RunBucketFailed, RunBucketSkipped}
+
+// stable codes of metering failures
+const (
+	// the OBC's secret or its access keys are missing
+	ErrorSecretMissing = "secret_missing"
+	// the OBC's configmap or its bucket name, host or port are missing
+	ErrorBucketInfoMissing   = "bucket_info_missing"
+	ErrorCredentialRejected  = "credential_rejected"
+	ErrorBucketNotFound      = "bucket_not_found"
+	ErrorEndpointUnreachable = "endpoint_unreachable"
+	ErrorTLS                 = "tls_error"
+	ErrorTimeout             = "timeout"
+	ErrorThrottled           = "throttled"
+	ErrorDatabase            = "database_error"
+	ErrorKubernetes          = "kubernetes_error"
+	// the run was cancelled while the bucket was metered
+	ErrorCancelled = "cancelled"
+	ErrorUnknown   = "unknown"
+)
+
+var ErrorClasses = []string{
+	ErrorSecretMissing,
+	ErrorBucketInfoMissing,
+	ErrorCredentialRejected,
+	ErrorBucketNotFound,
+	ErrorEndpointUnreachable,
+	ErrorTLS,
+	ErrorTimeout,
+	ErrorThrottled,
+	ErrorDatabase,
+	ErrorKubernetes,
+	ErrorCancelled,
+	ErrorUnknown,
+}
+
+// RunBucket is the result of metering one bucket in one run
+type RunBucket struct {
+	ID            int       `json:"id"`
+	RunId         int       `json:"run_id"`
+	BucketUid     string    `json:"bucket_uid"`
+	Name          string    `json:"name"`
+	Namespace     string    `json:"namespace"`
+	Status        string    `json:"status"`
+	ErrorClass    *string   `json:"error_class"`
+	ErrorMessage  *string   `json:"error_message"`
+	DurationMs    int64     `json:"duration_ms"`
+	ObjectsListed uint64    `json:"objects_listed"`
+	ApiCalls      int       `json:"api_calls"`
+	Attempts      int       `json:"attempts"`
+	FinishedAt    time.Time `json:"finished_at"`
+}
+
+type InsertRunBucketArgs struct {
+	RunId         int
+	BucketUid     string
+	Name          string
+	Namespace     string
+	Status        string
+	ErrorClass    *string
+	ErrorMessage  *string
+	Duration      time.Duration
+	ObjectsListed uint64
+	ApiCalls      int
+	Attempts      int
+}
+
+// InsertRunBucket stores the bucket's result, a later result in the same run replaces it
+func InsertRunBucket(args InsertRunBucketArgs) error {
+	sql := `
+		INSERT INTO run_buckets (run_id, bucket_uid, name, namespace, status, error_class, error_message, duration_ms, objects_listed, api_calls, attempts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (run_id, bucket_uid) DO UPDATE
+		SET status = $5, error_class = $6, error_message = $7, duration_ms = $8, objects_listed = $9, api_calls = $10, attempts = $11, finished_at = NOW()
+		`
+
+	_, err := pool.Exec(
+		context.TODO(),
+		sql,
+		args.RunId,
+		args.BucketUid,
+		args.Name,
+		args.Namespace,
+		args.Status,
+		args.ErrorClass,
+		args.ErrorMessage,
+		args.Duration.Milliseconds(),
+		args.ObjectsListed,
+		args.ApiCalls,
+		args.Attempts,
+	)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+type GetRunBucketsArgs struct {
+	RunIds       *[]string
+	Uids         *[]string
+	Statuses     *[]string
+	ErrorClasses *[]string
+}
+
+// newest runs first
+func GetRunBuckets(args GetRunBucketsArgs) ([]RunBucket, error) {
+	whereStatements := []string{}
+	sqlVars := []interface{}{}
+
+	if args.RunIds != nil {
+		whereStatements = append(whereStatements, "run_id = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.RunIds)
+	}
+
+	if args.Uids != nil {
+		whereStatements = append(whereStatements, "bucket_uid = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Uids)
+	}
+
+	if args.Statuses != nil {
+		whereStatements = append(whereStatements, "status = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Statuses)
+	}
+
+	if args.ErrorClasses != nil {
+		whereStatements = append(whereStatements, "error_class = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.ErrorClasses)
+	}
+
+	sql := `
+		SELECT id, run_id, bucket_uid, name, namespace, status, error_class, error_message, duration_ms, objects_listed, api_calls, attempts, finished_at
+		FROM run_buckets
+		`
+
+	if len(whereStatements) > 0 {
+		sql = sql + "WHERE " + strings.Join(whereStatements, " AND ")
+	}
+
+	sql = sql + " ORDER BY run_id DESC, namespace, name"
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	runBuckets := []RunBucket{}
+	for rows.Next() {
+		var runBucket RunBucket
+		err := rows.Scan(
+			&runBucket.ID,
+			&runBucket.RunId,
+			&runBucket.BucketUid,
+			&runBucket.Name,
+			&runBucket.Namespace,
+			&runBucket.Status,
+			&runBucket.ErrorClass,
+			&runBucket.ErrorMessage,
+			&runBucket.DurationMs,
+			&runBucket.ObjectsListed,
+			&runBucket.ApiCalls,
+			&runBucket.Attempts,
+			&runBucket.FinishedAt,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		runBuckets = append(runBuckets, runBucket)
+	}
+
+	return runBuckets, rows.Err()
+}
+
+type ErrorClassCount struct {
+	ErrorClass string `json:"error_class"`
+	Count      int    `json:"count"`
+}
+
+// CountRunErrors counts the run's failed buckets per error class
+func CountRunErrors(runId int) ([]ErrorClassCount, error) {
+	sql := `
+		SELECT COALESCE(error_class, $2), COUNT(*)
+		FROM run_buckets
+		WHERE run_id = $1 AND status = $3
+		GROUP BY 1
+		ORDER BY 1
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, runId, ErrorUnknown, RunBucketFailed)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []ErrorClassCount{}
+	for rows.Next() {
+		var count ErrorClassCount
+		err := rows.Scan(&count.ErrorClass, &count.Count)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
@@ -2,12 +2,29 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	// some buckets failed
+	RunPartial = "partial"
+	// every bucket failed, or the run stopped on an error of its own
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+	// the process running it stopped without closing it
+	RunAbandoned = "abandoned"
 )
 
+var RunStatuses = []string{RunRunning, RunSucceeded, RunPartial, RunFailed, RunCancelled, RunAbandoned}
+
 type Run struct {
 	ID            int        `json:"id"`
 	StartTime     time.Time  `json:"start_time"`
@@ -16,11 +33,24 @@ type Run struct {
 	FailedUids    []string   `json:"failed_uids"`
 	ErrorMessages []string   `json:"error_messages"`
 	Trigger       string     `json:"trigger"`
+	// the run whose failed buckets this run retried
+	RetryOf *int `json:"retry_of"`
+	// progress, updated as buckets finish
+	BucketsTotal   int        `json:"buckets_total"`
+	BucketsDone    int        `json:"buckets_done"`
+	BucketsFailed  int        `json:"buckets_failed"`
+	CurrentBuckets []string   `json:"current_buckets"`
+	CancelledAt    *time.Time `json:"cancelled_at"`
+	// set when cancelling was requested, the run is cancelled at its next heartbeat
+	CancelRequestedAt *time.Time `json:"cancel_requested_at"`
+	Status            string     `json:"status"`
+	HeartbeatAt       time.Time  `json:"heartbeat_at"`
 }
 
-func OpenRun(trigger string) (*int, error) {
-	sql := `INSERT INTO	runs (all_uids, failed_uids, error_messages, trigger)
-	VALUES ($1, $2, $3, $4)
+// retryOf is the run whose failed buckets are retried, nil for other runs
+func OpenRun(trigger string, retryOf *int) (*int, error) {
+	sql := `INSERT INTO	runs (all_uids, failed_uids, error_messages, trigger, retry_of)
+	VALUES ($1, $2, $3, $4, $5)
 	RETURNING id
 	`
 
@@ -33,6 +63,7 @@ func OpenRun(trigger string) (*int, error) {
 		[]string{},
 		[]string{},
 		trigger,
+		retryOf,
 	).Scan(&id)
 
 	if err != nil {
@@ -43,19 +74,123 @@ func OpenRun(trigger string) (*int, error) {
 	return &id, nil
 }
 
+// processes take it before deciding whether a scheduled run is due
+const scheduleLockId = 7301947
+
+// OpenDueRun opens a run unless one is in progress or a run of the policy (automatic or
+// scheduled) started less than interval ago, in any process. It returns nil when the run isn't
+// due. Processes decide under an advisory lock so only one of them opens it.
+func OpenDueRun(trigger string, interval time.Duration) (*int, error) {
+	ctx := context.Background()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// released when the transaction ends, the run it opens is then visible to the others
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", scheduleLockId)
+	if err != nil {
+		fmt.Println("Failed to take the schedule lock")
+		return nil, err
+	}
+
+	var due bool
+	err = tx.QueryRow(
+		ctx,
+		`SELECT NOT EXISTS (
+			SELECT 1 FROM runs
+			WHERE status = 'running' OR (trigger IN ('automatic', 'scheduled') AND start_time > NOW() - make_interval(secs => $1))
+		)`,
+		interval.Seconds(),
+	).Scan(&due)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	if !due {
+		return nil, nil
+	}
+
+	var id int
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO runs (all_uids, failed_uids, error_messages, trigger)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		[]string{},
+		[]string{},
+		[]string{},
+		trigger,
+	).Scan(&id)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &id, nil
+}
+
 type CloseRunArgs struct {
 	AllUids       []string
 	FailedUids    []string
 	ErrorMessages []string
+	// stopped before every bucket was metered
+	Cancelled bool
+	// stopped on an error of its own, such as failing to list the buckets
+	Failed bool
+}
+
+func (args CloseRunArgs) status() string {
+	switch {
+	case args.Cancelled:
+		return RunCancelled
+	case args.Failed || (len(args.FailedUids) > 0 && len(args.FailedUids) == len(args.AllUids)):
+		return RunFailed
+	case len(args.FailedUids) > 0:
+		return RunPartial
+	default:
+		return RunSucceeded
+	}
 }
 
 func CloseRun(id int, args CloseRunArgs) error {
 	sql := `UPDATE runs
-			SET end_time = NOW(), all_uids = $2, failed_uids = $3, error_messages = $4
+			SET end_time = NOW(), heartbeat_at = NOW(), all_uids = $2, failed_uids = $3, error_messages = $4, current_buckets = '{}',
+				cancelled_at = CASE WHEN $5 THEN NOW() END, status = $6
 			WHERE id = $1
 `
 
-	_, err := pool.Exec(context.TODO(), sql, id, args.AllUids, args.FailedUids, args.ErrorMessages)
+	_, err := pool.Exec(context.TODO(), sql, id, args.AllUids, args.FailedUids, args.ErrorMessages, args.Cancelled, args.status())
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+type RunProgressArgs struct {
+	BucketsTotal   int
+	BucketsDone    int
+	BucketsFailed  int
+	CurrentBuckets []string
+}
+
+func UpdateRunProgress(id int, args RunProgressArgs) error {
+	sql := `UPDATE runs
+			SET buckets_total = $2, buckets_done = $3, buckets_failed = $4, current_buckets = $5, heartbeat_at = NOW()
+			WHERE id = $1 AND status = 'running'
+`
+
+	_, err := pool.Exec(context.TODO(), sql, id, args.BucketsTotal, args.BucketsDone, args.BucketsFailed, args.CurrentBuckets)
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -64,11 +199,73 @@ func CloseRun(id int, args CloseRunArgs) error {
 	return nil
 }
 
+// HeartbeatRun notes that the run is still in progress, and returns whether cancelling it was requested
+func HeartbeatRun(id int) (bool, error) {
+	sql := `UPDATE runs SET heartbeat_at = NOW() WHERE id = $1 AND status = 'running' RETURNING cancel_requested_at IS NOT NULL`
+
+	var cancelRequested bool
+	err := pool.QueryRow(context.TODO(), sql, id).Scan(&cancelRequested)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+
+	return cancelRequested, nil
+}
+
+// RequestRunCancel asks the process running the run to cancel it, it returns false when the
+// run isn't running
+func RequestRunCancel(id int) (bool, error) {
+	sql := `UPDATE runs SET cancel_requested_at = COALESCE(cancel_requested_at, NOW()) WHERE id = $1 AND status = 'running'`
+
+	tag, err := pool.Exec(context.TODO(), sql, id)
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// AbandonStaleRuns closes the running runs without a heartbeat for staleAfter as abandoned,
+// ending them at their last heartbeat. It returns their ids.
+func AbandonStaleRuns(staleAfter time.Duration) ([]int, error) {
+	sql := `UPDATE runs
+			SET status = 'abandoned', end_time = heartbeat_at, current_buckets = '{}'
+			WHERE status = 'running' AND heartbeat_at < $1
+			RETURNING id
+`
+
+	rows, err := pool.Query(context.TODO(), sql, time.Now().Add(-staleAfter))
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 type GetRunsArgs struct {
 	Ids      *[]string
 	FromTime *time.Time
 	ToTime   *time.Time
 	Trigger  *string
+	Statuses *[]string
 }
 
 func GetRuns(args GetRunsArgs) (*[]Run, error) {
@@ -85,6 +282,11 @@ func GetRuns(args GetRunsArgs) (*[]Run, error) {
 		sqlVars = append(sqlVars, *args.Trigger)
 	}
 
+	if args.Statuses != nil {
+		whereStatements = append(whereStatements, "status = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Statuses)
+	}
+
 	if args.FromTime != nil {
 		whereStatements = append(whereStatements, "end_time > $"+strconv.Itoa(len(whereStatements)+1))
 		sqlVars = append(sqlVars, *args.FromTime)
@@ -96,7 +298,7 @@ func GetRuns(args GetRunsArgs) (*[]Run, error) {
 	}
 
 	sql := `
-			SELECT id, start_time, end_time, all_uids, failed_uids, error_messages, trigger 
+			SELECT ` + runColumns + `
 			FROM runs
 			`
 
@@ -115,15 +317,7 @@ func GetRuns(args GetRunsArgs) (*[]Run, error) {
 	var runs []Run
 	for rows.Next() {
 		var run Run
-		err := rows.Scan(
-			&run.ID,
-			&run.StartTime,
-			&run.EndTime,
-			&run.AllUids,
-			&run.FailedUids,
-			&run.ErrorMessages,
-			&run.Trigger,
-		)
+		err := rows.Scan(runDestinations(&run)...)
 
 		if err != nil {
 			fmt.Println(err)
@@ -136,3 +330,62 @@ func GetRuns(args GetRunsArgs) (*[]Run, error) {
 	return &runs, nil
 
 }
+
+type GetLatestRunArgs struct {
+	// only consider runs that succeeded
+	Successful bool
+}
+
+// GetLatestRun leaves out abandoned runs, their end is only their last heartbeat
+func GetLatestRun(args GetLatestRunArgs) (*Run, error) {
+	sql := `
+			SELECT ` + runColumns + `
+			FROM runs
+			WHERE end_time IS NOT NULL AND status <> 'abandoned'
+			`
+
+	if args.Successful {
+		sql = sql + "AND status = 'succeeded' "
+	}
+
+	sql = sql + "ORDER BY end_time DESC LIMIT 1"
+
+	var run Run
+	err := pool.QueryRow(context.TODO(), sql).Scan(runDestinations(&run)...)
+
+	if err != nil {
+		// not a real error
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return nil, nil
+		}
+
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+const runColumns = "id, start_time, end_time, all_uids, failed_uids, error_messages, trigger, retry_of, buckets_total, buckets_done, buckets_failed, current_buckets, cancelled_at, cancel_requested_at, status, heartbeat_at"
+
+// runDestinations are the fields of run scanned from runColumns, in the same order
+func runDestinations(run *Run) []any {
+	return []any{
+		&run.ID,
+		&run.StartTime,
+		&run.EndTime,
+		&run.AllUids,
+		&run.FailedUids,
+		&run.ErrorMessages,
+		&run.Trigger,
+		&run.RetryOf,
+		&run.BucketsTotal,
+		&run.BucketsDone,
+		&run.BucketsFailed,
+		&run.CurrentBuckets,
+		&run.CancelledAt,
+		&run.CancelRequestedAt,
+		&run.Status,
+		&run.HeartbeatAt,
+	}
+}
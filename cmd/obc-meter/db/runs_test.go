@@ -0,0 +1,23 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunDestinations(t *testing.T) {
+	columns := strings.Split(runColumns, ", ")
+	destinations := runDestinations(&Run{})
+
+	if len(destinations) != len(columns) {
+		t.Fatalf("runDestinations() has %v destinations for %v columns", len(destinations), len(columns))
+	}
+
+	seen := map[any]string{}
+	for i, destination := range destinations {
+		if column, ok := seen[destination]; ok {
+			t.Errorf("columns '%v' and '%v' are scanned into the same field", column, columns[i])
+		}
+		seen[destination] = columns[i]
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BucketUsageAt struct {
+	Bucket Bucket `json:"bucket"`
+	// "metered" when a record covers the instant, "not_yet_metered" otherwise
+	Status string  `json:"status"`
+	Record *Record `json:"record"`
+}
+
+type GetUsageAtArgs struct {
+	Time       time.Time
+	Uids       *[]string
+	Namespaces *[]string
+	// open records not verified for this long are marked stale, never when zero
+	StaleAfter time.Duration
+}
+
+// usage of every bucket that existed at the given instant, including buckets deleted since
+func GetUsageAt(args GetUsageAtArgs) (*[]BucketUsageAt, error) {
+	whereStatements := []string{
+		"(b.created_at IS NULL OR b.created_at <= $1)",
+		"(b.deleted_at IS NULL OR b.deleted_at > $1)",
+	}
+	sqlVars := []interface{}{args.Time}
+
+	if args.Uids != nil {
+		whereStatements = append(whereStatements, "b.uid = ANY($"+strconv.Itoa(len(sqlVars)+1)+")")
+		sqlVars = append(sqlVars, *args.Uids)
+	}
+
+	if args.Namespaces != nil {
+		whereStatements = append(whereStatements, "b.namespace = ANY($"+strconv.Itoa(len(sqlVars)+1)+")")
+		sqlVars = append(sqlVars, *args.Namespaces)
+	}
+
+	sql := `
+		SELECT b.uid, b.name, b.namespace, b.bucket_name, b.storage_class, b.account, b.labels, b.max_size, b.max_objects, b.created_at, b.first_seen, b.last_seen, b.deleted_at,
+			r.id, r.period_start, r.period_end, r.objects_count, r.bytes_total, r.run_id, r.observed_start, r.observed_end, verified.last_verified_at, verified.last_verified_run_id
+		FROM buckets b
+		LEFT JOIN records r ON r.bucket_uid = b.uid AND r.period_start <= $1 AND (r.period_end IS NULL OR r.period_end > $1)
+		LEFT JOIN LATERAL (
+			SELECT o.observed_end AS last_verified_at, o.run_id AS last_verified_run_id
+			FROM observations o
+			WHERE o.record_id = r.id
+			ORDER BY o.observed_end DESC
+			LIMIT 1
+		) verified ON true
+		WHERE ` + strings.Join(whereStatements, " AND ") + `
+		ORDER BY b.namespace, b.name
+		`
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var usage []BucketUsageAt
+	for rows.Next() {
+		var bucket Bucket
+		var recordId *int
+		var periodStart *time.Time
+		var periodEnd *time.Time
+		var objectsCount *uint64
+		var bytesTotal *uint64
+		var runId *int
+		var observedStart *time.Time
+		var observedEnd *time.Time
+		var lastVerifiedAt *time.Time
+		var lastVerifiedRunId *int
+
+		err := rows.Scan(
+			&bucket.Uid,
+			&bucket.Name,
+			&bucket.Namespace,
+			&bucket.BucketName,
+			&bucket.StorageClass,
+			&bucket.Account,
+			&bucket.Labels,
+			&bucket.MaxSize,
+			&bucket.MaxObjects,
+			&bucket.CreatedAt,
+			&bucket.FirstSeen,
+			&bucket.LastSeen,
+			&bucket.DeletedAt,
+			&recordId,
+			&periodStart,
+			&periodEnd,
+			&objectsCount,
+			&bytesTotal,
+			&runId,
+			&observedStart,
+			&observedEnd,
+			&lastVerifiedAt,
+			&lastVerifiedRunId,
+		)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		bucketUsage := BucketUsageAt{Bucket: bucket, Status: "not_yet_metered"}
+
+		if recordId != nil {
+			bucketUsage.Status = "metered"
+			bucketUsage.Record = &Record{
+				ID:                *recordId,
+				BucketUid:         bucket.Uid,
+				PeriodStart:       *periodStart,
+				PeriodEnd:         periodEnd,
+				ObjectsCount:      *objectsCount,
+				BytesTotal:        *bytesTotal,
+				RunId:             *runId,
+				ObservedStart:     observedStart,
+				ObservedEnd:       observedEnd,
+				LastVerifiedAt:    lastVerifiedAt,
+				LastVerifiedRunId: lastVerifiedRunId,
+			}
+			bucketUsage.Record.markStale(args.StaleAfter, now)
+		}
+
+		usage = append(usage, bucketUsage)
+	}
+
+	return &usage, nil
+}
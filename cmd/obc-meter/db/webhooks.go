@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type WebhookDelivery struct {
+	ID        int    `json:"id"`
+	EventId   string `json:"event_id"`
+	EventType string `json:"event_type"`
+	Url       string `json:"url"`
+	// the CloudEvent as sent
+	Payload []byte `json:"-"`
+	// pending, delivered or failed
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus *int       `json:"response_status"`
+	LastError      *string    `json:"last_error"`
+	ReplayOf       *int       `json:"replay_of"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	// pending deliveries are attempted from then on
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+}
+
+// InsertWebhookDelivery stores a pending delivery, claimed by the caller until claimedUntil so no
+// other process attempts it meanwhile
+func InsertWebhookDelivery(delivery WebhookDelivery, claimedUntil time.Time) (*WebhookDelivery, error) {
+	sql := `INSERT INTO webhook_deliveries (event_id, event_type, url, payload, replay_of, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, attempts, created_at, next_attempt_at
+	`
+
+	err := pool.QueryRow(
+		context.TODO(),
+		sql,
+		delivery.EventId,
+		delivery.EventType,
+		delivery.Url,
+		string(delivery.Payload),
+		delivery.ReplayOf,
+		claimedUntil,
+	).Scan(&delivery.ID, &delivery.Status, &delivery.Attempts, &delivery.CreatedAt, &delivery.NextAttemptAt)
+
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+type RecordWebhookAttemptArgs struct {
+	Status         string
+	ResponseStatus *int
+	LastError      *string
+	// when to attempt a delivery left pending again
+	NextAttemptAt *time.Time
+}
+
+func RecordWebhookAttempt(id int, args RecordWebhookAttemptArgs) error {
+	sql := `UPDATE webhook_deliveries
+		SET status = $2, response_status = $3, last_error = $4, attempts = attempts + 1, last_attempt_at = NOW(),
+			delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() ELSE NULL END, next_attempt_at = $5
+		WHERE id = $1
+	`
+
+	_, err := pool.Exec(context.TODO(), sql, id, args.Status, args.ResponseStatus, args.LastError, args.NextAttemptAt)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+type GetWebhookDeliveriesArgs struct {
+	Ids        *[]string
+	EventIds   *[]string
+	EventTypes *[]string
+	Statuses   *[]string
+	FromTime   *time.Time
+	ToTime     *time.Time
+}
+
+func GetWebhookDeliveries(args GetWebhookDeliveriesArgs) (*[]WebhookDelivery, error) {
+	whereStatements := []string{}
+	sqlVars := []interface{}{}
+
+	if args.Ids != nil {
+		whereStatements = append(whereStatements, "id = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Ids)
+	}
+
+	if args.EventIds != nil {
+		whereStatements = append(whereStatements, "event_id = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.EventIds)
+	}
+
+	if args.EventTypes != nil {
+		whereStatements = append(whereStatements, "event_type = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.EventTypes)
+	}
+
+	if args.Statuses != nil {
+		whereStatements = append(whereStatements, "status = ANY($"+strconv.Itoa(len(whereStatements)+1)+")")
+		sqlVars = append(sqlVars, *args.Statuses)
+	}
+
+	if args.FromTime != nil {
+		whereStatements = append(whereStatements, "created_at >= $"+strconv.Itoa(len(whereStatements)+1))
+		sqlVars = append(sqlVars, *args.FromTime)
+	}
+
+	if args.ToTime != nil {
+		whereStatements = append(whereStatements, "created_at < $"+strconv.Itoa(len(whereStatements)+1))
+		sqlVars = append(sqlVars, *args.ToTime)
+	}
+
+	sql := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		`
+
+	if len(whereStatements) > 0 {
+		sql = sql + "WHERE " + strings.Join(whereStatements, " AND ")
+	}
+
+	sql = sql + " ORDER BY created_at DESC"
+
+	rows, err := pool.Query(context.TODO(), sql, sqlVars...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		deliveries = append(deliveries, *delivery)
+	}
+
+	return &deliveries, nil
+}
+
+// ClaimPendingWebhookDeliveries returns up to limit pending deliveries due for an attempt,
+// claimed by the caller until claimedUntil
+func ClaimPendingWebhookDeliveries(limit int, claimedUntil time.Time) ([]WebhookDelivery, error) {
+	sql := `UPDATE webhook_deliveries
+		SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + webhookDeliveryColumns
+
+	rows, err := pool.Query(context.TODO(), sql, limit, claimedUntil)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+
+		deliveries = append(deliveries, *delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+const webhookDeliveryColumns = "id, event_id, event_type, url, payload, status, attempts, response_status, last_error, replay_of, created_at, last_attempt_at, delivered_at, next_attempt_at"
+
+func scanWebhookDelivery(rows pgx.Rows) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := rows.Scan(
+		&delivery.ID,
+		&delivery.EventId,
+		&delivery.EventType,
+		&delivery.Url,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.ReplayOf,
+		&delivery.CreatedAt,
+		&delivery.LastAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.NextAttemptAt,
+	)
+
+	return &delivery, err
+}
@@ -0,0 +1,239 @@
+// Rows follow the FinOps Open Cost and Usage Specification (FOCUS) 1.0.
+// Every record interval is split on UTC day boundaries so each row is a daily charge
+// that falls inside a single (calendar month) billing period.
+//
+// The custom x_Estimated and x_Stale columns flag charges for usage within a gap without
+// observations and for current usage not verified lately, billing can leave them out or refuse
+// the export instead.
+package focus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/pricing"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/usage"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+)
+
+type Row struct {
+	BilledCost          float64   `parquet:"BilledCost"`
+	BillingAccountId    string    `parquet:"BillingAccountId"`
+	BillingAccountName  string    `parquet:"BillingAccountName"`
+	BillingCurrency     string    `parquet:"BillingCurrency"`
+	BillingPeriodStart  time.Time `parquet:"BillingPeriodStart,timestamp"`
+	BillingPeriodEnd    time.Time `parquet:"BillingPeriodEnd,timestamp"`
+	ChargeCategory      string    `parquet:"ChargeCategory"`
+	ChargeClass         *string   `parquet:"ChargeClass,optional"`
+	ChargeDescription   string    `parquet:"ChargeDescription"`
+	ChargeFrequency     string    `parquet:"ChargeFrequency"`
+	ChargePeriodStart   time.Time `parquet:"ChargePeriodStart,timestamp"`
+	ChargePeriodEnd     time.Time `parquet:"ChargePeriodEnd,timestamp"`
+	ConsumedQuantity    float64   `parquet:"ConsumedQuantity"`
+	ConsumedUnit        string    `parquet:"ConsumedUnit"`
+	ContractedCost      float64   `parquet:"ContractedCost"`
+	ContractedUnitPrice float64   `parquet:"ContractedUnitPrice"`
+	EffectiveCost       float64   `parquet:"EffectiveCost"`
+	InvoiceIssuerName   string    `parquet:"InvoiceIssuerName"`
+	ListCost            float64   `parquet:"ListCost"`
+	ListUnitPrice       float64   `parquet:"ListUnitPrice"`
+	PricingCategory     string    `parquet:"PricingCategory"`
+	PricingQuantity     float64   `parquet:"PricingQuantity"`
+	PricingUnit         string    `parquet:"PricingUnit"`
+	ProviderName        string    `parquet:"ProviderName"`
+	PublisherName       string    `parquet:"PublisherName"`
+	ResourceId          string    `parquet:"ResourceId"`
+	ResourceName        string    `parquet:"ResourceName"`
+	ResourceType        string    `parquet:"ResourceType"`
+	ServiceCategory     string    `parquet:"ServiceCategory"`
+	ServiceName         string    `parquet:"ServiceName"`
+	SkuId               string    `parquet:"SkuId"`
+	SkuPriceId          string    `parquet:"SkuPriceId"`
+	SubAccountId        string    `parquet:"SubAccountId"`
+	SubAccountName      string    `parquet:"SubAccountName"`
+	Tags                string    `parquet:"Tags"`
+	XEstimated          bool      `parquet:"x_Estimated"`
+	XStale              bool      `parquet:"x_Stale"`
+}
+
+// what to do with stale records
+const (
+	StaleInclude = "include"
+	StaleExclude = "exclude"
+	StaleRefuse  = "refuse"
+)
+
+var StaleOptions = []string{StaleInclude, StaleExclude, StaleRefuse}
+
+// charges are constant over a record, there is nothing to interpolate
+var Fills = []string{db.FillCarryForward, db.FillExclude}
+
+// DefaultFill is the configured fill, carrying usage forward instead of interpolating it
+func DefaultFill() string {
+	fill := utils.GetConfig().Metering.Fill
+	if fill == db.FillInterpolate {
+		return db.FillCarryForward
+	}
+
+	return fill
+}
+
+// returned with StaleRefuse when a record in the period is stale
+var ErrStaleUsage = errors.New("the usage of some buckets is stale")
+
+type GetRowsArgs struct {
+	Uids       *[]string
+	FromPeriod time.Time
+	ToPeriod   time.Time
+	// records not verified for this long are stale, observations further apart leave gaps
+	StaleAfter time.Duration
+	// one of Fills, applied to the usage within gaps
+	Fill  string
+	Stale string
+}
+
+func GetRows(args GetRowsArgs) (*[]Row, error) {
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{
+		Uids:       args.Uids,
+		FromPeriod: &args.FromPeriod,
+		ToPeriod:   &args.ToPeriod,
+		StaleAfter: args.StaleAfter,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	gaps, err := usage.FindGaps(usage.FindGapsArgs{Uids: args.Uids, From: args.FromPeriod, To: args.ToPeriod, MaxInterval: args.StaleAfter})
+	if err != nil {
+		return nil, err
+	}
+
+	staleUids := []string{}
+	uids := []string{}
+	marked := []db.Record{}
+	for _, record := range usage.MarkEstimated(*records, gaps, args.ToPeriod, args.Fill) {
+		if record.Stale && args.Stale == StaleExclude {
+			continue
+		}
+
+		if record.Stale {
+			staleUids = append(staleUids, record.BucketUid)
+		}
+
+		uids = append(uids, record.BucketUid)
+		marked = append(marked, record)
+	}
+
+	if len(staleUids) > 0 && args.Stale == StaleRefuse {
+		return nil, fmt.Errorf("%w: %v", ErrStaleUsage, strings.Join(staleUids, ", "))
+	}
+
+	buckets, err := db.GetBuckets(db.GetBucketsArgs{Uids: &uids})
+	if err != nil {
+		return nil, err
+	}
+
+	bucketsByUid := map[string]db.Bucket{}
+	for _, bucket := range *buckets {
+		bucketsByUid[bucket.Uid] = bucket
+	}
+
+	rows := []Row{}
+	for _, record := range marked {
+		bucket, ok := bucketsByUid[record.BucketUid]
+		if !ok {
+			// metered before bucket metadata was collected
+			bucket = db.Bucket{Uid: record.BucketUid, BucketName: record.BucketUid}
+		}
+
+		start := record.PeriodStart
+		end := args.ToPeriod
+		if record.PeriodEnd != nil {
+			end = *record.PeriodEnd
+		}
+
+		for start.Before(end) {
+			dayEnd := startOfDay(start).AddDate(0, 0, 1)
+			if dayEnd.After(end) {
+				dayEnd = end
+			}
+
+			row := newRow(bucket, record.BytesTotal, start, dayEnd)
+			row.XEstimated = record.Estimated
+			row.XStale = record.Stale
+			rows = append(rows, row)
+			start = dayEnd
+		}
+	}
+
+	return &rows, nil
+}
+
+func newRow(bucket db.Bucket, bytesTotal uint64, start time.Time, end time.Time) Row {
+	duration := end.Sub(start)
+	billingPeriodStart := time.Date(start.UTC().Year(), start.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	cost := pricing.Cost(bytesTotal, duration)
+
+	tags, _ := json.Marshal(map[string]string{
+		"bucket_uid":    bucket.Uid,
+		"namespace":     bucket.Namespace,
+		"obc_name":      bucket.Name,
+		"storage_class": bucket.StorageClass,
+	})
+
+	return Row{
+		BilledCost:          cost,
+		BillingAccountId:    getBillingAccount(),
+		BillingAccountName:  getBillingAccount(),
+		BillingCurrency:     pricing.Currency(),
+		BillingPeriodStart:  billingPeriodStart,
+		BillingPeriodEnd:    billingPeriodStart.AddDate(0, 1, 0),
+		ChargeCategory:      "Usage",
+		ChargeClass:         nil,
+		ChargeDescription:   fmt.Sprintf("Object storage for bucket %v in namespace %v", bucket.BucketName, bucket.Namespace),
+		ChargeFrequency:     "Usage-Based",
+		ChargePeriodStart:   start,
+		ChargePeriodEnd:     end,
+		ConsumedQuantity:    pricing.GiBHours(bytesTotal, duration),
+		ConsumedUnit:        "GiB-Hours",
+		ContractedCost:      cost,
+		ContractedUnitPrice: pricing.PricePerGiBMonth(),
+		EffectiveCost:       cost,
+		InvoiceIssuerName:   "obc-meter",
+		ListCost:            cost,
+		ListUnitPrice:       pricing.PricePerGiBMonth(),
+		PricingCategory:     "Standard",
+		PricingQuantity:     pricing.GiBMonths(bytesTotal, duration),
+		PricingUnit:         "GiB-Months",
+		ProviderName:        "obc-meter",
+		PublisherName:       "obc-meter",
+		ResourceId:          getResourceId(bucket),
+		ResourceName:        bucket.BucketName,
+		ResourceType:        "ObjectBucketClaim",
+		ServiceCategory:     "Storage",
+		ServiceName:         "Object Storage",
+		SkuId:               bucket.StorageClass,
+		SkuPriceId:          bucket.StorageClass,
+		SubAccountId:        bucket.Namespace,
+		SubAccountName:      bucket.Namespace,
+		Tags:                string(tags),
+	}
+}
+
+func getResourceId(bucket db.Bucket) string {
+	return "objectbucketclaims/" + bucket.Namespace + "/" + bucket.BucketName + "/" + bucket.Uid
+}
+
+func getBillingAccount() string {
+	return utils.GetConfig().ClusterName
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
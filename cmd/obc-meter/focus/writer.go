@@ -0,0 +1,145 @@
+package focus
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+var columns = []string{
+	"BilledCost",
+	"BillingAccountId",
+	"BillingAccountName",
+	"BillingCurrency",
+	"BillingPeriodStart",
+	"BillingPeriodEnd",
+	"ChargeCategory",
+	"ChargeClass",
+	"ChargeDescription",
+	"ChargeFrequency",
+	"ChargePeriodStart",
+	"ChargePeriodEnd",
+	"ConsumedQuantity",
+	"ConsumedUnit",
+	"ContractedCost",
+	"ContractedUnitPrice",
+	"EffectiveCost",
+	"InvoiceIssuerName",
+	"ListCost",
+	"ListUnitPrice",
+	"PricingCategory",
+	"PricingQuantity",
+	"PricingUnit",
+	"ProviderName",
+	"PublisherName",
+	"ResourceId",
+	"ResourceName",
+	"ResourceType",
+	"ServiceCategory",
+	"ServiceName",
+	"SkuId",
+	"SkuPriceId",
+	"SubAccountId",
+	"SubAccountName",
+	"Tags",
+	"x_Estimated",
+	"x_Stale",
+}
+
+func Write(w io.Writer, format string, rows []Row) error {
+	switch format {
+	case "csv":
+		return WriteCSV(w, rows)
+	case "parquet":
+		return WriteParquet(w, rows)
+	default:
+		return errors.New("Unsupported format '" + format + "', expected 'csv' or 'parquet'")
+	}
+}
+
+func ContentType(format string) string {
+	if format == "parquet" {
+		return "application/vnd.apache.parquet"
+	} else {
+		return "text/csv"
+	}
+}
+
+func WriteCSV(w io.Writer, rows []Row) error {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write(columns)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		chargeClass := ""
+		if row.ChargeClass != nil {
+			chargeClass = *row.ChargeClass
+		}
+
+		err := writer.Write([]string{
+			formatFloat(row.BilledCost),
+			row.BillingAccountId,
+			row.BillingAccountName,
+			row.BillingCurrency,
+			formatTime(row.BillingPeriodStart),
+			formatTime(row.BillingPeriodEnd),
+			row.ChargeCategory,
+			chargeClass,
+			row.ChargeDescription,
+			row.ChargeFrequency,
+			formatTime(row.ChargePeriodStart),
+			formatTime(row.ChargePeriodEnd),
+			formatFloat(row.ConsumedQuantity),
+			row.ConsumedUnit,
+			formatFloat(row.ContractedCost),
+			formatFloat(row.ContractedUnitPrice),
+			formatFloat(row.EffectiveCost),
+			row.InvoiceIssuerName,
+			formatFloat(row.ListCost),
+			formatFloat(row.ListUnitPrice),
+			row.PricingCategory,
+			formatFloat(row.PricingQuantity),
+			row.PricingUnit,
+			row.ProviderName,
+			row.PublisherName,
+			row.ResourceId,
+			row.ResourceName,
+			row.ResourceType,
+			row.ServiceCategory,
+			row.ServiceName,
+			row.SkuId,
+			row.SkuPriceId,
+			row.SubAccountId,
+			row.SubAccountName,
+			row.Tags,
+			strconv.FormatBool(row.XEstimated),
+			strconv.FormatBool(row.XStale),
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func WriteParquet(w io.Writer, rows []Row) error {
+	return parquet.Write(w, rows)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
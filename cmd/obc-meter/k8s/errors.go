@@ -0,0 +1,179 @@
+package k8s
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Metering failures carry one of the stable db.ErrorClasses so they can be filtered and
+// counted without matching error messages.
+
+type meteringError struct {
+	class string
+	err   error
+	// reason of the Warning event recorded on the OBC when its last attempt fails, none when empty
+	eventReason string
+}
+
+func (e *meteringError) Error() string {
+	return e.err.Error()
+}
+
+func (e *meteringError) Unwrap() error {
+	return e.err
+}
+
+// classify attaches the error's class: the one it already carries, the one its causes
+// reveal (timeouts, TLS, S3 error codes...) or the fallback of the step that failed
+func classify(err error, fallback string) error {
+	var classified *meteringError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	class := classifyCause(err)
+	if class == "" {
+		class = fallback
+	}
+
+	return &meteringError{class: class, err: err}
+}
+
+// errorClass returns the class of a classified error, unknown otherwise
+func errorClass(err error) string {
+	var classified *meteringError
+	if errors.As(err, &classified) {
+		return classified.class
+	}
+
+	return db.ErrorUnknown
+}
+
+// withEventReason sets the reason of the event recorded for a classified error
+func withEventReason(err error, reason string) error {
+	var classified *meteringError
+	if errors.As(err, &classified) {
+		classified.eventReason = reason
+	}
+
+	return err
+}
+
+func eventReason(err error) string {
+	var classified *meteringError
+	if errors.As(err, &classified) {
+		return classified.eventReason
+	}
+
+	return ""
+}
+
+// failures that may not happen again when the bucket is metered a moment later
+var retryableErrorClasses = []string{db.ErrorEndpointUnreachable, db.ErrorTimeout, db.ErrorThrottled, db.ErrorDatabase}
+
+func isRetryable(err error) bool {
+	return slices.Contains(retryableErrorClasses, errorClass(err))
+}
+
+var credentialErrorCodes = []string{"InvalidAccessKeyId", "SignatureDoesNotMatch", "AccessDenied", "InvalidToken", "ExpiredToken"}
+var throttlingErrorCodes = []string{"SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests", "RequestThrottled"}
+var timeoutErrorCodes = []string{"RequestTimeout", "RequestTimeoutException"}
+
+// the code of S3 requests whose context was cancelled
+const requestCanceledCode = "RequestCanceled"
+
+func classifyCause(err error) string {
+	for _, cause := range causes(err) {
+		if awsErr, ok := cause.(awserr.Error); ok {
+			switch code := awsErr.Code(); {
+			case slices.Contains(credentialErrorCodes, code):
+				return db.ErrorCredentialRejected
+			case code == "NoSuchBucket":
+				return db.ErrorBucketNotFound
+			case slices.Contains(throttlingErrorCodes, code):
+				return db.ErrorThrottled
+			case slices.Contains(timeoutErrorCodes, code):
+				return db.ErrorTimeout
+			case code == requestCanceledCode:
+				return db.ErrorCancelled
+			}
+		}
+
+		if failure, ok := cause.(awserr.RequestFailure); ok {
+			switch failure.StatusCode() {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				return db.ErrorCredentialRejected
+			case http.StatusNotFound:
+				return db.ErrorBucketNotFound
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				return db.ErrorThrottled
+			}
+		}
+
+		switch cause.(type) {
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError,
+			*tls.CertificateVerificationError, tls.RecordHeaderError, tls.AlertError:
+			return db.ErrorTLS
+		case *net.DNSError:
+			return db.ErrorEndpointUnreachable
+		}
+
+		if apierrors.IsTimeout(cause) || apierrors.IsServerTimeout(cause) {
+			return db.ErrorTimeout
+		}
+
+		if apierrors.IsTooManyRequests(cause) {
+			return db.ErrorThrottled
+		}
+
+		if errors.Is(cause, context.Canceled) {
+			return db.ErrorCancelled
+		}
+
+		if errors.Is(cause, context.DeadlineExceeded) {
+			return db.ErrorTimeout
+		}
+
+		if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+			return db.ErrorTimeout
+		}
+
+		if errors.Is(cause, syscall.ECONNREFUSED) || errors.Is(cause, syscall.EHOSTUNREACH) || errors.Is(cause, syscall.ENETUNREACH) {
+			return db.ErrorEndpointUnreachable
+		}
+
+		if opErr, ok := cause.(*net.OpError); ok && opErr.Op == "dial" {
+			return db.ErrorEndpointUnreachable
+		}
+	}
+
+	return ""
+}
+
+// causes lists the error and everything it wraps, including the original errors of AWS errors
+func causes(err error) []error {
+	list := []error{}
+	for err != nil {
+		list = append(list, err)
+
+		next := errors.Unwrap(err)
+		if next == nil {
+			if awsErr, ok := err.(awserr.Error); ok {
+				next = awsErr.OrigErr()
+			}
+		}
+		err = next
+	}
+
+	return list
+}
@@ -5,17 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/anomaly"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/budget"
 	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/quota"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/webhook"
 	obcv1alpha1 "github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
@@ -50,9 +59,11 @@ func connectToKubernetes() {
 	var config *rest.Config
 	_ = obcv1alpha1.AddToScheme(scheme)
 
-	if os.Getenv("APP_ENV") == "development" {
-		K8S_API_URL := os.Getenv("K8S_API_URL")
-		K8S_API_TOKEN := os.Getenv("K8S_API_TOKEN")
+	cfg := utils.GetConfig()
+
+	if cfg.AppEnv == "development" {
+		K8S_API_URL := cfg.Kubernetes.ApiUrl
+		K8S_API_TOKEN := cfg.Kubernetes.ApiToken
 		if K8S_API_URL == "" {
 			log.Fatalln("Variable 'K8S_API_URL' is required during development")
 		}
@@ -111,33 +122,151 @@ func connectToKubernetes() {
 
 func StartMeteringObjectBuckets() {
 	connectToKubernetes()
+	syncPolicy()
+	go sweepAbandonedRuns()
 	meterObjectBuckets("automatic")
 }
 
+// sweepAbandonedRuns keeps closing the runs left open by processes that stopped while running
+// them, a process restarted quickly finds its previous run's heartbeat still fresh
+func sweepAbandonedRuns() {
+	for {
+		abandonStaleRuns()
+		time.Sleep(runHeartbeatInterval)
+	}
+}
+
+func abandonStaleRuns() {
+	ids, err := db.AbandonStaleRuns(runStaleAfter)
+	if err != nil {
+		fmt.Println(err)
+		log.Println("Failed to close abandoned runs")
+		return
+	}
+
+	for _, id := range ids {
+		log.Printf("Closed run '%v' as abandoned, it has had no heartbeat for %v\n", id, runStaleAfter)
+		emitRunEvent(webhook.TypeRunAbandoned, id)
+	}
+}
+
+// runs of this process never overlap
+var meteringLock sync.Mutex
+
+// returned when a retry is requested while a run is in progress
+var ErrRunInProgress = errors.New("a metering run is in progress")
+
+// meterObjectBuckets waits for the run in progress, if any, then meters the buckets of the policy
 func meterObjectBuckets(trigger string) {
-	log.Println("Running Metering")
+	meteringLock.Lock()
+	defer meteringLock.Unlock()
+
+	runPolicy(trigger)
+}
+
+// runPolicy opens and executes a run of the current policy. Scheduled runs are only opened when
+// due, by a single process. Called with meteringLock held.
+func runPolicy(trigger string) {
+	started := time.Now()
+	policy := getPolicy()
+
+	var runId *int
+	var err error
+	if trigger == "scheduled" {
+		runId, err = db.OpenDueRun(trigger, policy.interval)
+	} else {
+		runId, err = db.OpenRun(trigger, nil)
+	}
 
-	runId, err := db.OpenRun(trigger)
 	if err != nil {
 		fmt.Println(err)
-		log.Fatal("Failed to start a run\n")
+		log.Println("Failed to start a run")
+		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	if runId == nil {
+		return
+	}
+
+	log.Println("Running Metering")
+
+	executeRun(*runId, policy, nil)
+	recordPolicyRun(started, policy.interval)
+}
+
+// RetryRun starts a run metering only the given buckets of a previous run, it doesn't wait for
+// the run to finish nor change the schedule
+func RetryRun(retryOf int, uids []string) (int, error) {
+	if !meteringLock.TryLock() {
+		return 0, ErrRunInProgress
+	}
+
+	log.Printf("Retrying '%v' buckets of run '%v'\n", len(uids), retryOf)
+
+	runId, err := db.OpenRun("retry", &retryOf)
+	if err != nil {
+		meteringLock.Unlock()
+		return 0, err
+	}
+
+	go func() {
+		defer meteringLock.Unlock()
+		executeRun(*runId, getPolicy(), uids)
+	}()
+
+	return *runId, nil
+}
+
+// executeRun meters the buckets selected by the policy, or only those of them in uids when set.
+// Buckets are only marked deleted by complete runs of every bucket.
+func executeRun(runId int, policy policy, uids []string) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+
+	startProgress(runId, cancelRun)
+	stopHeartbeat := startHeartbeat(runId, cancelRun)
+	defer stopHeartbeat()
+
+	emitRunEvent(webhook.TypeRunStarted, runId)
+
+	ctx, cancel := context.WithTimeout(runCtx, time.Second*30)
 	defer cancel()
 
-	res, err := client.Resource(OBCGroupVersionResource).List(ctx, v1.ListOptions{
-		LabelSelector: labels.SelectorFromSet(map[string]string{
-			getLabelKey(): "true",
-		}).String(),
-	})
+	// every OBC is listed, buckets that only left the policy are not deleted
+	res, err := client.Resource(OBCGroupVersionResource).List(ctx, v1.ListOptions{})
 
 	if err != nil {
 		fmt.Println(err)
-		log.Fatal("Failed to list object buckets")
+		log.Println("Failed to list object buckets")
+
+		closeRun(runId, db.CloseRunArgs{
+			AllUids:       []string{},
+			FailedUids:    []string{},
+			ErrorMessages: []string{"Failed to list object buckets: " + err.Error()},
+			Cancelled:     runCtx.Err() != nil,
+			Failed:        true,
+		})
+		return
 	}
 
-	log.Printf("Found '%v' ObjectBucketClaims to meter\n", len(res.Items))
+	existingUids := []string{}
+	items := []unstructured.Unstructured{}
+	for _, obc := range res.Items {
+		existingUids = append(existingUids, string(obc.GetUID()))
+
+		if !policy.selector.Matches(labels.Set(obc.GetLabels())) || !policy.includesNamespace(obc.GetNamespace()) {
+			continue
+		}
+
+		if uids != nil && !slices.Contains(uids, string(obc.GetUID())) {
+			continue
+		}
+
+		items = append(items, obc)
+	}
+
+	log.Printf("Found '%v' ObjectBucketClaims to meter\n", len(items))
+	setBucketsTotal(len(items))
 
 	runSummary := db.CloseRunArgs{
 		AllUids:       []string{},
@@ -145,79 +274,330 @@ func meterObjectBuckets(trigger string) {
 		ErrorMessages: []string{},
 	}
 
-	for i := 0; i < len(res.Items); i++ {
-		obc := res.Items[i]
+	var summaryLock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, policy.concurrency)
+
+	for i := 0; i < len(items); i++ {
+		obc := items[i]
 		uid := string(obc.GetUID())
 
-		_, err := meterObjectBucket(obc.GetName(), uid, obc.GetNamespace(), *runId)
+		// buckets not started yet are left out of cancelled runs
+		select {
+		case slots <- struct{}{}:
+		case <-runCtx.Done():
+		}
+		if runCtx.Err() != nil {
+			break
+		}
 
-		runSummary.AllUids = append(runSummary.AllUids, uid)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			bucket := obc.GetNamespace() + "/" + obc.GetName()
+			bucketStarted(bucket)
+
+			started := time.Now()
+			status := db.RunBucketFailed
+			attempts := 0
+			apiCalls := 0
+			var stats *bucketStats
+
+			claim, err := convertToObjectBucketClaim(&obc)
+			if err != nil {
+				err = classify(err, db.ErrorUnknown)
+			} else if policy.collector(claim.Spec.StorageClassName) == CollectorDisabled {
+				log.Printf("Skipping bucket, metering is disabled for storage class '%v' [Name=%v, Uid=%v, Namespace=%v]\n", claim.Spec.StorageClassName, claim.GetName(), uid, claim.GetNamespace())
+				status = db.RunBucketSkipped
+			} else {
+				cfg := utils.GetConfig().Metering
+				backoff := cfg.RetryBackoff.Duration
+
+				for {
+					attempts++
+					status, stats, err = meterObjectBucket(runCtx, claim, runId)
+					if stats != nil {
+						apiCalls += stats.apiCalls
+					}
+
+					if err == nil || attempts >= cfg.RetryAttempts || !isRetryable(err) || runCtx.Err() != nil {
+						break
+					}
+
+					log.Printf("Retrying bucket in %v after %v error (attempt %v of %v) [Name=%v, Uid=%v, Namespace=%v]\n", backoff, errorClass(err), attempts+1, cfg.RetryAttempts, claim.GetName(), uid, claim.GetNamespace())
+
+					select {
+					case <-time.After(backoff):
+					case <-runCtx.Done():
+						err = classify(runCtx.Err(), db.ErrorCancelled)
+					}
+					if runCtx.Err() != nil {
+						break
+					}
+					backoff *= 2
+				}
+
+				// only the last attempt's failure is reported on the OBC
+				if reason := eventReason(err); reason != "" {
+					recordFailureEvent(claim, reason, err)
+				}
+			}
+
+			recordRunBucket(runId, &obc, runBucketResult{
+				status:   status,
+				stats:    stats,
+				err:      err,
+				duration: time.Since(started),
+				attempts: attempts,
+				apiCalls: apiCalls,
+			})
+
+			bucketFinished(bucket, err != nil)
+
+			summaryLock.Lock()
+			defer summaryLock.Unlock()
+
+			runSummary.AllUids = append(runSummary.AllUids, uid)
+
+			if err != nil {
+				runSummary.FailedUids = append(runSummary.FailedUids, uid)
+				runSummary.ErrorMessages = append(runSummary.ErrorMessages, err.Error())
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	runSummary.Cancelled = runCtx.Err() != nil
+
+	_, err = anomaly.DetectRunAnomalies(runId)
+	if err != nil {
+		fmt.Println(err)
+		log.Println("Failed to detect anomalies")
+	}
+
+	_, err = budget.EvaluateBudgets(runId)
+	if err != nil {
+		fmt.Println(err)
+		log.Println("Failed to evaluate budgets")
+	}
 
+	if uids == nil && !runSummary.Cancelled {
+		removedUids, err := db.MarkBucketsDeleted(existingUids)
 		if err != nil {
-			runSummary.FailedUids = append(runSummary.FailedUids, uid)
-			runSummary.ErrorMessages = append(runSummary.ErrorMessages, err.Error())
+			fmt.Println(err)
+			log.Println("Failed to mark deleted buckets")
 		}
+
+		emitBucketEvents(webhook.TypeBucketRemoved, removedUids)
 	}
 
-	err = db.CloseRun(*runId, runSummary)
+	closeRun(runId, runSummary)
+
+	applyRetention(policy.retention)
+
+	if runSummary.Cancelled {
+		log.Printf("Cancelled metering after '%v' of '%v' ObjectBucketClaims\n", len(runSummary.AllUids), len(items))
+		return
+	}
 
-	log.Printf("Finished metering '%v' ObjectBucketClaims\n", len(res.Items))
+	log.Printf("Finished metering '%v' ObjectBucketClaims\n", len(items))
 }
 
-func meterObjectBucket(name string, uid string, namespace string, runId int) (bool, error) {
+// closeRun stores the run's outcome, ends its progress and emits its final event
+func closeRun(runId int, summary db.CloseRunArgs) {
+	err := db.CloseRun(runId, summary)
+	if err != nil {
+		fmt.Println(err)
+		log.Println("Failed to close run")
+	}
+
+	finishProgress(summary.Cancelled)
+
+	if summary.Cancelled {
+		emitRunEvent(webhook.TypeRunCancelled, runId)
+	} else if summary.Failed || len(summary.FailedUids) > 0 {
+		emitRunEvent(webhook.TypeRunFailed, runId)
+	} else {
+		emitRunEvent(webhook.TypeRunFinished, runId)
+	}
+}
+
+// meterObjectBucket returns the bucket's run status, and the listing's stats once listed
+func meterObjectBucket(ctx context.Context, claim *obcv1alpha1.ObjectBucketClaim, runId int) (string, *bucketStats, error) {
+	name := claim.GetName()
+	uid := string(claim.GetUID())
+	namespace := claim.GetNamespace()
+
 	fmt.Printf("\nMetering Bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-	keys, err := getBucketKeys(name, namespace)
+	keys, err := getBucketKeys(ctx, name, namespace)
 	if err != nil {
 		fmt.Println(err)
 		log.Printf("Failed to meter bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-		return false, err
+		return db.RunBucketFailed, nil, withEventReason(classify(err, db.ErrorKubernetes), ReasonMissingCredentials)
 	}
 
-	config, err := getBucketConfig(name, namespace)
+	config, err := getBucketConfig(ctx, name, namespace)
 	if err != nil {
 		fmt.Println(err)
 		log.Printf("Failed to meter bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-		return false, err
+		return db.RunBucketFailed, nil, withEventReason(classify(err, db.ErrorKubernetes), ReasonMissingBucketInfo)
+	}
+
+	maxSize := parseQuota(claim.Spec.AdditionalConfig["maxSize"])
+	maxObjects := parseQuota(claim.Spec.AdditionalConfig["maxObjects"])
+
+	added, err := db.UpsertBucket(db.UpsertBucketArgs{
+		Uid:          uid,
+		Name:         name,
+		Namespace:    namespace,
+		BucketName:   config.name,
+		StorageClass: claim.Spec.StorageClassName,
+		Account:      claim.GetLabels()[getAccountLabelKey()],
+		Labels:       claim.GetLabels(),
+		MaxSize:      maxSize,
+		MaxObjects:   maxObjects,
+		CreatedAt:    claim.GetCreationTimestamp().Time,
+	})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to meter bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
+		return db.RunBucketFailed, nil, classify(err, db.ErrorDatabase)
+	}
+
+	if added {
+		emitBucketEvents(webhook.TypeBucketAdded, []string{uid})
 	}
 
-	stats, err := getBucketStats(config, keys)
+	stats, err := getBucketStats(ctx, config, keys)
 	if err != nil {
 		fmt.Println(err)
 		log.Printf("Failed to meter bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-		return false, err
+		return db.RunBucketFailed, stats, withEventReason(classify(err, db.ErrorUnknown), ReasonBucketListFailed)
 	}
 
 	currentRecord, err := db.GetBucketCurrentRecord(uid)
 	if err != nil {
 		fmt.Println(err)
 		log.Printf("Failed to meter bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-		return false, err
+		return db.RunBucketFailed, stats, classify(err, db.ErrorDatabase)
+	}
+
+	_, err = quota.Evaluate(quota.EvaluateArgs{
+		BucketUid:    uid,
+		RunId:        runId,
+		MaxSize:      maxSize,
+		MaxObjects:   maxObjects,
+		BytesTotal:   uint64(stats.bytesTotal),
+		ObjectsCount: uint64(stats.objectsCount),
+	})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to evaluate quotas [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
 	}
 
 	// no previous record or previous record is changed
 	if currentRecord == nil || stats.bytesTotal != uint(currentRecord.BytesTotal) || stats.objectsCount != uint(currentRecord.ObjectsCount) {
-		_, err := db.AppendBucketUsageRecord(db.AppendBucketUsageRecordArgs{
-			BucketUid:    uid,
-			ObjectsCount: uint64(stats.objectsCount),
-			BytesTotal:   uint64(stats.bytesTotal),
-			RunId:        runId,
+		record, created, err := db.AppendBucketUsageRecord(db.AppendBucketUsageRecordArgs{
+			BucketUid:     uid,
+			ObjectsCount:  uint64(stats.objectsCount),
+			BytesTotal:    uint64(stats.bytesTotal),
+			RunId:         runId,
+			ObservedStart: stats.observedStart,
+			ObservedEnd:   stats.observedEnd,
 		})
 
 		if err != nil {
 			fmt.Println(err)
 			log.Printf("Failed to meter bucket [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-			return false, err
+			return db.RunBucketFailed, stats, classify(err, db.ErrorDatabase)
 		}
 
+		recordObservation(uid, runId, record.ID, stats)
+
+		if !created {
+			log.Printf("Successfully metered bucket (ALREADY RECORDED) [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
+			return db.RunBucketUnchanged, stats, nil
+		}
+
+		if currentRecord != nil {
+			// closed in the same transaction the new record was opened
+			currentRecord.PeriodEnd = &record.PeriodStart
+			webhook.Emit(webhook.TypeRecordClosed, "records/"+strconv.Itoa(currentRecord.ID), currentRecord)
+		}
+		webhook.Emit(webhook.TypeRecordOpened, "records/"+strconv.Itoa(record.ID), record)
+
+		annotateUsage(claim, uint64(stats.bytesTotal), uint64(stats.objectsCount))
 		log.Printf("Successfully metered bucket (UPDATED) [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
 
-		return true, nil
+		return db.RunBucketUpdated, stats, nil
 
 	} else {
+		recordObservation(uid, runId, currentRecord.ID, stats)
+		annotateUsage(claim, uint64(stats.bytesTotal), uint64(stats.objectsCount))
 		log.Printf("Successfully metered bucket (UNCHANGED) [Name=%v, Uid=%v, Namespace=%v]\n", name, uid, namespace)
-		return false, nil
+		return db.RunBucketUnchanged, stats, nil
+	}
+
+}
+
+type runBucketResult struct {
+	status string
+	// of the last attempt
+	stats    *bucketStats
+	err      error
+	duration time.Duration
+	attempts int
+	// over every attempt
+	apiCalls int
+}
+
+// recordRunBucket stores the bucket's result in the run
+func recordRunBucket(runId int, obc *unstructured.Unstructured, result runBucketResult) {
+	args := db.InsertRunBucketArgs{
+		RunId:     runId,
+		BucketUid: string(obc.GetUID()),
+		Name:      obc.GetName(),
+		Namespace: obc.GetNamespace(),
+		Status:    result.status,
+		Duration:  result.duration,
+		ApiCalls:  result.apiCalls,
+		Attempts:  max(result.attempts, 1),
+	}
+
+	if result.stats != nil {
+		args.ObjectsListed = uint64(result.stats.objectsCount)
+	}
+
+	if result.err != nil {
+		message := result.err.Error()
+		class := errorClass(result.err)
+		args.ErrorMessage = &message
+		args.ErrorClass = &class
+	}
+
+	err := db.InsertRunBucket(args)
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to record run result [Uid=%v]\n", args.BucketUid)
 	}
+}
 
+// recordObservation notes that the record's usage was confirmed by this run's measurement
+func recordObservation(uid string, runId int, recordId int, stats *bucketStats) {
+	err := db.InsertObservation(db.InsertObservationArgs{
+		BucketUid:     uid,
+		RunId:         runId,
+		RecordId:      recordId,
+		ObservedStart: stats.observedStart,
+		ObservedEnd:   stats.observedEnd,
+	})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to record observation [Uid=%v]\n", uid)
+	}
 }
 
 type bucketKeys struct {
@@ -225,9 +605,11 @@ type bucketKeys struct {
 	secretKey   string
 }
 
-func getBucketKeys(secretName string, namespace string) (*bucketKeys, error) {
-	ctx := context.TODO()
+func getBucketKeys(ctx context.Context, secretName string, namespace string) (*bucketKeys, error) {
 	obj, err := client.Resource(SCGroupResourceVersion).Namespace(namespace).Get(ctx, secretName, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, &meteringError{class: db.ErrorSecretMissing, err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -243,11 +625,11 @@ func getBucketKeys(secretName string, namespace string) (*bucketKeys, error) {
 	}
 
 	if keys.accessKeyId == "" {
-		return nil, errors.New("Could not retrieve 'AWS_ACCESS_KEY_ID'")
+		return nil, &meteringError{class: db.ErrorSecretMissing, err: errors.New("Could not retrieve 'AWS_ACCESS_KEY_ID'")}
 	}
 
 	if keys.secretKey == "" {
-		return nil, errors.New("Could not retrieve 'AWS_SECRET_ACCESS_KEY'")
+		return nil, &meteringError{class: db.ErrorSecretMissing, err: errors.New("Could not retrieve 'AWS_SECRET_ACCESS_KEY'")}
 	}
 
 	return &keys, nil
@@ -260,9 +642,11 @@ type bucketConfig struct {
 	region string
 }
 
-func getBucketConfig(configmapName string, namespace string) (*bucketConfig, error) {
-	ctx := context.TODO()
+func getBucketConfig(ctx context.Context, configmapName string, namespace string) (*bucketConfig, error) {
 	obj, err := client.Resource(CMGroupResourceVersion).Namespace(namespace).Get(ctx, configmapName, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, &meteringError{class: db.ErrorBucketInfoMissing, err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -280,14 +664,14 @@ func getBucketConfig(configmapName string, namespace string) (*bucketConfig, err
 	}
 
 	if config.name == "" {
-		return nil, errors.New("Could not retrieve 'BUCKET_NAME'")
+		return nil, &meteringError{class: db.ErrorBucketInfoMissing, err: errors.New("Could not retrieve 'BUCKET_NAME'")}
 	}
 
 	if config.host == "" {
-		return nil, errors.New("Could not retrieve 'BUCKET_HOST'")
+		return nil, &meteringError{class: db.ErrorBucketInfoMissing, err: errors.New("Could not retrieve 'BUCKET_HOST'")}
 	}
 	if config.port == "" {
-		return nil, errors.New("Could not retrieve 'BUCKET_PORT'")
+		return nil, &meteringError{class: db.ErrorBucketInfoMissing, err: errors.New("Could not retrieve 'BUCKET_PORT'")}
 	}
 	if config.region == "" {
 		config.region = "us-east-1"
@@ -299,9 +683,14 @@ func getBucketConfig(configmapName string, namespace string) (*bucketConfig, err
 type bucketStats struct {
 	objectsCount uint
 	bytesTotal   uint
+	// the listing started and finished at these times, the usage was observed somewhere in between
+	observedStart time.Time
+	observedEnd   time.Time
+	// requests made to the S3 endpoint, including failed ones
+	apiCalls int
 }
 
-func getBucketStats(config *bucketConfig, keys *bucketKeys) (*bucketStats, error) {
+func getBucketStats(ctx context.Context, config *bucketConfig, keys *bucketKeys) (*bucketStats, error) {
 	sess, err := session.NewSession(&aws.Config{
 		Endpoint:         aws.String(getEndpoint(config.host, config.port)),
 		Region:           aws.String(config.region),
@@ -315,26 +704,41 @@ func getBucketStats(config *bucketConfig, keys *bucketKeys) (*bucketStats, error
 
 	svc := s3.New(sess)
 
-	result, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(config.name)})
-
-	if err != nil {
-		return nil, err
-	}
-
 	stats := bucketStats{
-		objectsCount: 0,
-		bytesTotal:   0,
+		objectsCount:  0,
+		bytesTotal:    0,
+		observedStart: time.Now(),
 	}
 
-	for i := 0; i < len(result.Contents); i++ {
-		obj := result.Contents[i]
-		stats.objectsCount += 1
-		stats.bytesTotal += uint(*obj.Size)
+	// every page is a request, a failing one ends the listing
+	err = svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(config.name)}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		stats.apiCalls++
+
+		for i := 0; i < len(page.Contents); i++ {
+			obj := page.Contents[i]
+			stats.objectsCount += 1
+			stats.bytesTotal += uint(*obj.Size)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return &bucketStats{apiCalls: stats.apiCalls + 1}, err
 	}
 
+	stats.observedEnd = time.Now()
+
 	return &stats, nil
 }
 
+func convertToObjectBucketClaim(obj *unstructured.Unstructured) (*obcv1alpha1.ObjectBucketClaim, error) {
+	claim := &obcv1alpha1.ObjectBucketClaim{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, claim)
+
+	return claim, err
+}
+
 func convertToSecret(obj *unstructured.Unstructured) (*corev1.Secret, error) {
 	secret := &corev1.Secret{}
 	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, secret)
@@ -358,10 +762,26 @@ func getEndpoint(host string, port string) string {
 }
 
 func getLabelKey() string {
-	labelKey := os.Getenv("LABEL_KEY")
-	if labelKey != "" {
-		return labelKey
-	} else {
-		return "meter-activated"
+	return utils.GetConfig().Metering.LabelKey
+}
+
+// buckets are attributed to the account named by this label on the OBC
+func getAccountLabelKey() string {
+	return utils.GetConfig().Metering.AccountLabelKey
+}
+
+// quotas are quantities such as "100Gi" or "5000", nil when unset or invalid
+func parseQuota(value string) *uint64 {
+	if value == "" {
+		return nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		log.Printf("Ignoring invalid quota '%v'\n", value)
+		return nil
 	}
+
+	n := uint64(quantity.Value())
+	return &n
 }
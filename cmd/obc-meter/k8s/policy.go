@@ -0,0 +1,390 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The cluster scoped MeteringPolicy named by METERING_POLICY_NAME ("default") configures metering.
+// It is polled and applied without restarts, an invalid policy keeps the previous one in effect.
+// Without a policy, buckets labelled LABEL_KEY=true are metered once at startup.
+var PolicyGroupVersionResource = schema.GroupVersionResource{
+	Group:    "obc-meter.io",
+	Version:  "v1alpha1",
+	Resource: "meteringpolicies",
+}
+
+const (
+	CollectorS3       = "s3"
+	CollectorDisabled = "disabled"
+)
+
+var Collectors = []string{CollectorS3, CollectorDisabled}
+
+// how often the policy is polled and the schedule checked
+const policySyncInterval = 30 * time.Second
+
+// schedules shorter than this would overlap with the runs themselves
+const minScheduleInterval = time.Minute
+
+const (
+	ConditionValid = "Valid"
+	ReasonApplied  = "Applied"
+	ReasonInvalid  = "InvalidSpec"
+	ReasonIgnored  = "Ignored"
+)
+
+type MeteringPolicy struct {
+	v1.TypeMeta   `json:",inline"`
+	v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MeteringPolicySpec   `json:"spec"`
+	Status MeteringPolicyStatus `json:"status,omitempty"`
+}
+
+type MeteringPolicySpec struct {
+	// a duration such as 30m, 6h or 1d, or one of @hourly, @daily, @weekly. Only metered at startup when unset
+	Schedule string `json:"schedule,omitempty"`
+	// OBCs to meter, LABEL_KEY=true when unset
+	Selector *v1.LabelSelector `json:"selector,omitempty"`
+	// namespaces to meter, all when empty
+	Namespaces []string `json:"namespaces,omitempty"`
+	// how buckets of each storage class are metered, "*" matches any storage class
+	Collectors []CollectorSpec `json:"collectors,omitempty"`
+	// buckets metered in parallel, 1 by default
+	Concurrency int `json:"concurrency,omitempty"`
+	// closed usage records older than this are deleted, kept forever when unset
+	Retention string `json:"retention,omitempty"`
+}
+
+type CollectorSpec struct {
+	StorageClass string `json:"storageClass"`
+	// s3 (list the bucket's objects) or disabled
+	Type string `json:"type"`
+}
+
+type MeteringPolicyStatus struct {
+	ObservedGeneration int64          `json:"observedGeneration,omitempty"`
+	Conditions         []v1.Condition `json:"conditions,omitempty"`
+	LastRunTime        *v1.Time       `json:"lastRunTime,omitempty"`
+	NextRunTime        *v1.Time       `json:"nextRunTime,omitempty"`
+}
+
+// policy is the validated form of a MeteringPolicySpec
+type policy struct {
+	interval    time.Duration
+	selector    labels.Selector
+	namespaces  map[string]bool
+	collectors  map[string]string
+	concurrency int
+	retention   time.Duration
+}
+
+var policyLock sync.RWMutex
+var activePolicy *policy
+var activePolicyGeneration int64
+
+func defaultPolicy() policy {
+	return policy{
+		selector:    labels.SelectorFromSet(map[string]string{getLabelKey(): "true"}),
+		namespaces:  map[string]bool{},
+		collectors:  map[string]string{},
+		concurrency: 1,
+	}
+}
+
+func getPolicy() policy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+
+	if activePolicy == nil {
+		return defaultPolicy()
+	}
+
+	return *activePolicy
+}
+
+// collector of the bucket's storage class, exact matches first
+func (p policy) collector(storageClass string) string {
+	if collector, ok := p.collectors[storageClass]; ok {
+		return collector
+	}
+
+	if collector, ok := p.collectors["*"]; ok {
+		return collector
+	}
+
+	return CollectorS3
+}
+
+func (p policy) includesNamespace(namespace string) bool {
+	return len(p.namespaces) == 0 || p.namespaces[namespace]
+}
+
+func parsePolicy(spec MeteringPolicySpec) (*policy, error) {
+	parsed := defaultPolicy()
+
+	if spec.Schedule != "" {
+		interval, err := parseSchedule(spec.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		parsed.interval = interval
+	}
+
+	if spec.Selector != nil {
+		selector, err := v1.LabelSelectorAsSelector(spec.Selector)
+		if err != nil {
+			return nil, errors.New("Invalid selector: " + err.Error())
+		}
+		parsed.selector = selector
+	}
+
+	for _, namespace := range spec.Namespaces {
+		parsed.namespaces[namespace] = true
+	}
+
+	for _, collector := range spec.Collectors {
+		if collector.StorageClass == "" {
+			return nil, errors.New("Collectors require a storageClass")
+		}
+
+		if !slices.Contains(Collectors, collector.Type) {
+			return nil, fmt.Errorf("Unknown collector type '%v' for storage class '%v', expected one of %v", collector.Type, collector.StorageClass, strings.Join(Collectors, ", "))
+		}
+
+		if _, ok := parsed.collectors[collector.StorageClass]; ok {
+			return nil, fmt.Errorf("Storage class '%v' has more than one collector", collector.StorageClass)
+		}
+		parsed.collectors[collector.StorageClass] = collector.Type
+	}
+
+	if spec.Concurrency < 0 {
+		return nil, errors.New("Concurrency must be at least 1")
+	}
+	if spec.Concurrency > 0 {
+		parsed.concurrency = spec.Concurrency
+	}
+
+	if spec.Retention != "" {
+		retention, err := utils.ParseDuration(spec.Retention)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("Invalid retention '%v', expected a duration such as 90d", spec.Retention)
+		}
+		parsed.retention = retention
+	}
+
+	return &parsed, nil
+}
+
+func parseSchedule(schedule string) (time.Duration, error) {
+	switch schedule {
+	case "@hourly":
+		return time.Hour, nil
+	case "@daily":
+		return 24 * time.Hour, nil
+	case "@weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+
+	interval, err := utils.ParseDuration(schedule)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid schedule '%v', expected a duration such as 6h or one of @hourly, @daily, @weekly", schedule)
+	}
+
+	if interval < minScheduleInterval {
+		return 0, fmt.Errorf("Invalid schedule '%v', runs must be at least %v apart", schedule, minScheduleInterval)
+	}
+
+	return interval, nil
+}
+
+func getPolicyName() string {
+	return utils.GetConfig().Metering.PolicyName
+}
+
+// syncPolicy applies the latest valid MeteringPolicy and reports validation on each policy's status
+func syncPolicy() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	list, err := client.Resource(PolicyGroupVersionResource).List(ctx, v1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		// CRD not installed
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		log.Println("Failed to list metering policies")
+		return
+	}
+
+	found := false
+	for i := range list.Items {
+		obj := list.Items[i]
+
+		item := MeteringPolicy{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &item)
+		if err != nil {
+			fmt.Println(err)
+			log.Printf("Failed to parse metering policy '%v'\n", obj.GetName())
+			continue
+		}
+
+		if item.GetName() != getPolicyName() {
+			if item.Status.ObservedGeneration != item.GetGeneration() {
+				setPolicyCondition(&obj, item, v1.ConditionFalse, ReasonIgnored, "Only the policy named '"+getPolicyName()+"' is applied")
+			}
+			continue
+		}
+
+		found = true
+
+		policyLock.RLock()
+		applied := activePolicy != nil && activePolicyGeneration == item.GetGeneration()
+		policyLock.RUnlock()
+
+		// already applied, or already reported as invalid
+		rejected := meta.IsStatusConditionFalse(item.Status.Conditions, ConditionValid)
+		if item.Status.ObservedGeneration == item.GetGeneration() && (applied || rejected) {
+			continue
+		}
+
+		parsed, err := parsePolicy(item.Spec)
+		if err != nil {
+			log.Printf("Metering policy '%v' is invalid: %v\n", item.GetName(), err)
+			setPolicyCondition(&obj, item, v1.ConditionFalse, ReasonInvalid, err.Error())
+			continue
+		}
+
+		policyLock.Lock()
+		activePolicy = parsed
+		activePolicyGeneration = item.GetGeneration()
+		policyLock.Unlock()
+
+		log.Printf("Applied metering policy '%v' (generation %v)\n", item.GetName(), item.GetGeneration())
+		setPolicyCondition(&obj, item, v1.ConditionTrue, ReasonApplied, "Policy is applied")
+	}
+
+	// back to the defaults when the policy is deleted
+	if !found {
+		policyLock.Lock()
+		if activePolicy != nil {
+			log.Println("Metering policy removed, using defaults")
+		}
+		activePolicy = nil
+		activePolicyGeneration = 0
+		policyLock.Unlock()
+	}
+}
+
+func setPolicyCondition(obj *unstructured.Unstructured, item MeteringPolicy, status v1.ConditionStatus, reason string, message string) {
+	item.Status.ObservedGeneration = item.GetGeneration()
+	meta.SetStatusCondition(&item.Status.Conditions, v1.Condition{
+		Type:               ConditionValid,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: item.GetGeneration(),
+	})
+
+	updatePolicyStatus(obj, item.Status)
+}
+
+func updatePolicyStatus(obj *unstructured.Unstructured, status MeteringPolicyStatus) {
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	obj.Object["status"] = statusObj
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = client.Resource(PolicyGroupVersionResource).UpdateStatus(ctx, obj, v1.UpdateOptions{})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to update status of metering policy '%v'\n", obj.GetName())
+	}
+}
+
+// recordPolicyRun stores the run times on the applied policy's status
+func recordPolicyRun(lastRun time.Time, interval time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	obj, err := client.Resource(PolicyGroupVersionResource).Get(ctx, getPolicyName(), v1.GetOptions{})
+	if err != nil {
+		// no policy (or no CRD), nothing to report on
+		return
+	}
+
+	item := MeteringPolicy{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &item)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	item.Status.LastRunTime = &v1.Time{Time: lastRun}
+	item.Status.NextRunTime = nil
+	if interval > 0 {
+		item.Status.NextRunTime = &v1.Time{Time: lastRun.Add(interval)}
+	}
+
+	updatePolicyStatus(obj, item.Status)
+}
+
+// StartScheduler keeps the policy in sync and starts runs on its schedule
+func StartScheduler() {
+	for {
+		time.Sleep(policySyncInterval)
+		syncPolicy()
+
+		// whether a run is due is decided from the runs of every process, in the background so a
+		// long run doesn't hold up policy syncs. A run still in progress delays the next one.
+		interval := getPolicy().interval
+		if interval > 0 && meteringLock.TryLock() {
+			go func() {
+				defer meteringLock.Unlock()
+				runPolicy("scheduled")
+			}()
+		}
+	}
+}
+
+// applyRetention deletes the usage records that closed before the retention period
+func applyRetention(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+
+	deleted, err := db.DeleteRecordsBefore(time.Now().Add(-retention))
+	if err != nil {
+		fmt.Println(err)
+		log.Println("Failed to apply retention")
+		return
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted '%v' usage records older than the retention period\n", deleted)
+	}
+}
@@ -0,0 +1,327 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+// The progress of the run in progress is kept in memory for subscribers, and written to the run
+// as buckets finish so it can be read from any replica. Subscribers on other replicas poll it.
+
+// running runs refresh their heartbeat this often, those without one for runStaleAfter are
+// considered abandoned
+const runHeartbeatInterval = 30 * time.Second
+const runStaleAfter = 10 * runHeartbeatInterval
+
+// subscribers of runs in progress in another process read their progress this often
+const runProgressPollInterval = 5 * time.Second
+
+type RunProgress struct {
+	RunId         int `json:"run_id"`
+	BucketsTotal  int `json:"buckets_total"`
+	BucketsDone   int `json:"buckets_done"`
+	BucketsFailed int `json:"buckets_failed"`
+	// namespace/name of the buckets being metered
+	CurrentBuckets []string `json:"current_buckets"`
+	Cancelled      bool     `json:"cancelled"`
+	Finished       bool     `json:"finished"`
+}
+
+type activeRun struct {
+	progress    RunProgress
+	cancel      context.CancelFunc
+	subscribers map[chan RunProgress]struct{}
+	// signals saveProgress that the progress changed
+	saves chan struct{}
+}
+
+var activeLock sync.Mutex
+var active *activeRun
+
+// returned when cancelling or following a run that isn't in progress
+var ErrRunNotActive = errors.New("the run is not in progress")
+
+// RunProgressOf is the progress last saved to the run
+func RunProgressOf(run db.Run) RunProgress {
+	return RunProgress{
+		RunId:          run.ID,
+		BucketsTotal:   run.BucketsTotal,
+		BucketsDone:    run.BucketsDone,
+		BucketsFailed:  run.BucketsFailed,
+		CurrentBuckets: run.CurrentBuckets,
+		Cancelled:      run.CancelledAt != nil,
+		Finished:       run.EndTime != nil,
+	}
+}
+
+func startProgress(runId int, cancel context.CancelFunc) {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+
+	active = &activeRun{
+		progress:    RunProgress{RunId: runId, CurrentBuckets: []string{}},
+		cancel:      cancel,
+		subscribers: map[chan RunProgress]struct{}{},
+		saves:       make(chan struct{}, 1),
+	}
+
+	go active.saveProgress()
+}
+
+// updateProgress applies update to the active run's progress, publishes it and has it saved
+func updateProgress(update func(progress *RunProgress)) {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+
+	if active == nil {
+		return
+	}
+
+	update(&active.progress)
+	active.publish()
+
+	select {
+	case active.saves <- struct{}{}:
+	default:
+	}
+}
+
+// saveProgress writes the latest progress to the run whenever it changes, outside of
+// activeLock. Updates made during a write are saved together by the next one.
+func (run *activeRun) saveProgress() {
+	for range run.saves {
+		activeLock.Lock()
+		progress := run.progress
+		activeLock.Unlock()
+
+		err := db.UpdateRunProgress(progress.RunId, db.RunProgressArgs{
+			BucketsTotal:   progress.BucketsTotal,
+			BucketsDone:    progress.BucketsDone,
+			BucketsFailed:  progress.BucketsFailed,
+			CurrentBuckets: progress.CurrentBuckets,
+		})
+		if err != nil {
+			fmt.Println(err)
+			log.Printf("Failed to save progress of run '%v'\n", progress.RunId)
+		}
+	}
+}
+
+func setBucketsTotal(total int) {
+	updateProgress(func(progress *RunProgress) {
+		progress.BucketsTotal = total
+	})
+}
+
+func bucketStarted(bucket string) {
+	updateProgress(func(progress *RunProgress) {
+		progress.CurrentBuckets = append(slices.Clone(progress.CurrentBuckets), bucket)
+	})
+}
+
+func bucketFinished(bucket string, failed bool) {
+	updateProgress(func(progress *RunProgress) {
+		progress.CurrentBuckets = slices.DeleteFunc(slices.Clone(progress.CurrentBuckets), func(current string) bool {
+			return current == bucket
+		})
+
+		progress.BucketsDone++
+		if failed {
+			progress.BucketsFailed++
+		}
+	})
+}
+
+// finishProgress publishes the final progress, once the run is closed, and ends subscriptions
+func finishProgress(cancelled bool) {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+
+	if active == nil {
+		return
+	}
+
+	active.progress.CurrentBuckets = []string{}
+	active.progress.Cancelled = cancelled
+	active.progress.Finished = true
+	active.publish()
+
+	for subscriber := range active.subscribers {
+		close(subscriber)
+	}
+
+	// progress saved after the run closed is ignored
+	close(active.saves)
+	active = nil
+}
+
+// publish replaces the progress waiting in each subscriber's channel, slow subscribers only
+// miss intermediate progress. Called with activeLock held.
+func (run *activeRun) publish() {
+	for subscriber := range run.subscribers {
+		select {
+		case <-subscriber:
+		default:
+		}
+		subscriber <- run.progress
+	}
+}
+
+// startHeartbeat refreshes the run's heartbeat until the returned function is called, and
+// cancels it once cancelling was requested from another process
+func startHeartbeat(runId int, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(runHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				cancelRequested, err := db.HeartbeatRun(runId)
+				if err != nil {
+					fmt.Println(err)
+					log.Printf("Failed to refresh heartbeat of run '%v'\n", runId)
+				}
+
+				if cancelRequested {
+					log.Printf("Cancelling run '%v' as requested\n", runId)
+					cancel()
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// CancelRun stops the run in progress, buckets being metered are abandoned and the run is
+// closed as cancelled. Runs in progress in another process are cancelled by it at their next
+// heartbeat.
+func CancelRun(runId int) error {
+	activeLock.Lock()
+	if active != nil && active.progress.RunId == runId {
+		defer activeLock.Unlock()
+
+		log.Printf("Cancelling run '%v'\n", runId)
+		active.cancel()
+		return nil
+	}
+	activeLock.Unlock()
+
+	requested, err := db.RequestRunCancel(runId)
+	if err != nil {
+		return err
+	}
+
+	if !requested {
+		return ErrRunNotActive
+	}
+
+	log.Printf("Requested cancelling run '%v' from the process running it\n", runId)
+	return nil
+}
+
+// SubscribeRun returns a channel receiving the run's current progress then each update, closed
+// once the run finishes. unsubscribe must be called when done reading.
+func SubscribeRun(runId int) (updates <-chan RunProgress, unsubscribe func(), err error) {
+	activeLock.Lock()
+	if active == nil || active.progress.RunId != runId {
+		activeLock.Unlock()
+		return pollRun(runId)
+	}
+	defer activeLock.Unlock()
+
+	run := active
+	subscriber := make(chan RunProgress, 1)
+	subscriber <- run.progress
+	run.subscribers[subscriber] = struct{}{}
+
+	unsubscribe = func() {
+		activeLock.Lock()
+		defer activeLock.Unlock()
+
+		delete(run.subscribers, subscriber)
+	}
+
+	return subscriber, unsubscribe, nil
+}
+
+// pollRun follows the progress saved by the process running the run
+func pollRun(runId int) (updates <-chan RunProgress, unsubscribe func(), err error) {
+	run, err := getRunningRun(runId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subscriber := make(chan RunProgress, 1)
+	subscriber <- RunProgressOf(*run)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(subscriber)
+
+		ticker := time.NewTicker(runProgressPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			runs, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{strconv.Itoa(runId)}})
+			if err != nil {
+				fmt.Println(err)
+				log.Printf("Failed to read progress of run '%v'\n", runId)
+				continue
+			}
+			if len(*runs) < 1 {
+				return
+			}
+
+			progress := RunProgressOf((*runs)[0])
+			select {
+			case <-subscriber:
+			default:
+			}
+			subscriber <- progress
+
+			if progress.Finished {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	unsubscribe = func() {
+		once.Do(func() { close(done) })
+	}
+
+	return subscriber, unsubscribe, nil
+}
+
+func getRunningRun(runId int) (*db.Run, error) {
+	runs, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{strconv.Itoa(runId)}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*runs) < 1 || (*runs)[0].Status != db.RunRunning {
+		return nil, ErrRunNotActive
+	}
+
+	return &(*runs)[0], nil
+}
@@ -0,0 +1,339 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/pricing"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/usage"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// BucketUsageReports let tenants request the usage of the OBCs in their own namespace,
+// the results are written to the report's status and optionally to a ConfigMap
+var ReportGroupVersionResource = schema.GroupVersionResource{
+	Group:    "obc-meter.io",
+	Version:  "v1alpha1",
+	Resource: "bucketusagereports",
+}
+
+const (
+	ReportPhaseReady  = "Ready"
+	ReportPhaseFailed = "Failed"
+)
+
+type BucketUsageReport struct {
+	v1.TypeMeta   `json:",inline"`
+	v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BucketUsageReportSpec   `json:"spec"`
+	Status BucketUsageReportStatus `json:"status,omitempty"`
+}
+
+type BucketUsageReportSpec struct {
+	From v1.Time `json:"from"`
+	// the report follows the current usage while unset
+	To *v1.Time `json:"to,omitempty"`
+	// OBCs of the report's namespace to include, all when unset. Deleted OBCs match on the labels
+	// they were last metered with.
+	Selector *v1.LabelSelector `json:"selector,omitempty"`
+	// optional ConfigMap (in the same namespace) receiving the report as report.json
+	ConfigMapName string `json:"configMapName,omitempty"`
+}
+
+type BucketUsageReportStatus struct {
+	Phase              string   `json:"phase,omitempty"`
+	Message            string   `json:"message,omitempty"`
+	ObservedGeneration int64    `json:"observedGeneration,omitempty"`
+	GeneratedAt        *v1.Time `json:"generatedAt,omitempty"`
+	From               *v1.Time `json:"from,omitempty"`
+	To                 *v1.Time `json:"to,omitempty"`
+	Currency           string   `json:"currency,omitempty"`
+
+	Buckets []BucketUsage `json:"buckets,omitempty"`
+	Total   *BucketUsage  `json:"total,omitempty"`
+}
+
+type BucketUsage struct {
+	Name         string  `json:"name,omitempty"`
+	Uid          string  `json:"uid,omitempty"`
+	StorageClass string  `json:"storageClass,omitempty"`
+	BytesTotal   int64   `json:"bytesTotal"`
+	ObjectsCount int64   `json:"objectsCount"`
+	BytesAvg     float64 `json:"bytesAvg"`
+	BytesMax     int64   `json:"bytesMax"`
+	GiBHours     float64 `json:"gibHours"`
+	Cost         float64 `json:"cost,omitempty"`
+}
+
+// StartReconcilingReports polls BucketUsageReports every metering.reportResyncInterval
+func StartReconcilingReports() {
+	interval := utils.GetConfig().Metering.ReportResync.Duration
+
+	for {
+		err := reconcileReports()
+		if apierrors.IsNotFound(err) {
+			log.Println("BucketUsageReport CRD is not installed, reports are disabled")
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			log.Println("Failed to reconcile bucket usage reports")
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func reconcileReports() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	list, err := client.Resource(ReportGroupVersionResource).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	if len(list.Items) == 0 {
+		return nil
+	}
+
+	latestRun, err := db.GetLatestRun(db.GetLatestRunArgs{})
+	if err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		obj := list.Items[i]
+
+		report := BucketUsageReport{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &report)
+		if err != nil {
+			fmt.Println(err)
+			log.Printf("Failed to parse bucket usage report [Name=%v, Namespace=%v]\n", obj.GetName(), obj.GetNamespace())
+			continue
+		}
+
+		if !reportNeedsUpdate(report, latestRun) {
+			continue
+		}
+
+		status := buildReportStatus(report)
+
+		err = updateReportStatus(&obj, status)
+		if err != nil {
+			fmt.Println(err)
+			log.Printf("Failed to update bucket usage report [Name=%v, Namespace=%v]\n", obj.GetName(), obj.GetNamespace())
+			continue
+		}
+
+		if report.Spec.ConfigMapName != "" && status.Phase == ReportPhaseReady {
+			err = writeReportConfigMap(report, status)
+			if err != nil {
+				fmt.Println(err)
+				log.Printf("Failed to write bucket usage report ConfigMap [Name=%v, Namespace=%v]\n", report.Spec.ConfigMapName, report.GetNamespace())
+			}
+		}
+	}
+
+	return nil
+}
+
+// reports are rebuilt when their spec changes, or while their period is open when a run finished since
+func reportNeedsUpdate(report BucketUsageReport, latestRun *db.Run) bool {
+	status := report.Status
+	if status.GeneratedAt == nil || status.ObservedGeneration != report.GetGeneration() {
+		return true
+	}
+
+	if report.Spec.To != nil && !report.Spec.To.After(status.GeneratedAt.Time) {
+		return false
+	}
+
+	return latestRun != nil && latestRun.EndTime != nil && latestRun.EndTime.After(status.GeneratedAt.Time)
+}
+
+func buildReportStatus(report BucketUsageReport) BucketUsageReportStatus {
+	now := v1.NewTime(time.Now())
+	status := BucketUsageReportStatus{
+		ObservedGeneration: report.GetGeneration(),
+		GeneratedAt:        &now,
+	}
+
+	failed := func(message string) BucketUsageReportStatus {
+		status.Phase = ReportPhaseFailed
+		status.Message = message
+		return status
+	}
+
+	from := report.Spec.From.Time
+	to := now.Time
+	if report.Spec.To != nil && report.Spec.To.Before(&now) {
+		to = report.Spec.To.Time
+	}
+
+	if !from.Before(to) {
+		return failed("spec.from must be before spec.to and in the past")
+	}
+
+	status.From = &v1.Time{Time: from}
+	status.To = &v1.Time{Time: to}
+
+	selector := labels.Everything()
+	if report.Spec.Selector != nil {
+		var err error
+		selector, err = v1.LabelSelectorAsSelector(report.Spec.Selector)
+		if err != nil {
+			return failed("Invalid spec.selector: " + err.Error())
+		}
+	}
+
+	// buckets come from the database rather than the cluster so OBCs deleted during the period
+	// are still reported, the selector applies to the labels they were last seen with
+	namespaces := []string{report.GetNamespace()}
+	buckets, err := db.GetBuckets(db.GetBucketsArgs{Namespaces: &namespaces})
+	if err != nil {
+		return failed("Failed to retrieve buckets")
+	}
+
+	uids := []string{}
+	bucketsByUid := map[string]db.Bucket{}
+	for _, bucket := range *buckets {
+		if bucket.CreatedAt != nil && !bucket.CreatedAt.Before(to) {
+			continue
+		}
+
+		if bucket.DeletedAt != nil && !bucket.DeletedAt.After(from) {
+			continue
+		}
+
+		if !selector.Matches(labels.Set(bucket.Labels)) {
+			continue
+		}
+
+		uids = append(uids, bucket.Uid)
+		bucketsByUid[bucket.Uid] = bucket
+	}
+
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{Uids: &uids, FromPeriod: &from, ToPeriod: &to})
+	if err != nil {
+		return failed("Failed to retrieve usage records")
+	}
+
+	if pricing.IsConfigured() {
+		status.Currency = pricing.Currency()
+	}
+
+	total := BucketUsage{}
+	status.Buckets = []BucketUsage{}
+	for _, summary := range usage.Summarize(*records, from, to) {
+		bucket := bucketsByUid[summary.BucketUid]
+
+		bucketUsage := BucketUsage{
+			Name:         bucket.Name,
+			Uid:          summary.BucketUid,
+			StorageClass: bucket.StorageClass,
+			BytesTotal:   int64(summary.BytesTotal),
+			ObjectsCount: int64(summary.ObjectsCount),
+			BytesAvg:     summary.BytesAvg,
+			BytesMax:     int64(summary.BytesMax),
+			GiBHours:     summary.GiBHours,
+			Cost:         summary.Cost,
+		}
+		status.Buckets = append(status.Buckets, bucketUsage)
+
+		total.BytesTotal += bucketUsage.BytesTotal
+		total.ObjectsCount += bucketUsage.ObjectsCount
+		total.BytesAvg += bucketUsage.BytesAvg
+		total.GiBHours += bucketUsage.GiBHours
+		total.Cost += bucketUsage.Cost
+	}
+
+	total.BytesMax = int64(usage.PeakBytes(*records, from, to))
+	status.Total = &total
+	status.Phase = ReportPhaseReady
+	status.Message = fmt.Sprintf("Usage of %v buckets", len(status.Buckets))
+
+	return status
+}
+
+func updateReportStatus(obj *unstructured.Unstructured, status BucketUsageReportStatus) error {
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return err
+	}
+
+	obj.Object["status"] = statusObj
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = client.Resource(ReportGroupVersionResource).Namespace(obj.GetNamespace()).UpdateStatus(ctx, obj, v1.UpdateOptions{})
+	return err
+}
+
+// the ConfigMap is owned by the report and removed with it
+func writeReportConfigMap(report BucketUsageReport, status BucketUsageReportStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	controller := true
+	configmap := corev1.ConfigMap{
+		TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      report.Spec.ConfigMapName,
+			Namespace: report.GetNamespace(),
+			OwnerReferences: []v1.OwnerReference{{
+				APIVersion: ReportGroupVersionResource.GroupVersion().String(),
+				Kind:       "BucketUsageReport",
+				Name:       report.GetName(),
+				UID:        report.GetUID(),
+				Controller: &controller,
+			}},
+		},
+		Data: map[string]string{"report.json": string(data)},
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&configmap)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resource := client.Resource(CMGroupResourceVersion).Namespace(report.GetNamespace())
+
+	existing, err := resource.Get(ctx, configmap.Name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = resource.Create(ctx, &unstructured.Unstructured{Object: obj}, v1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// never take over a ConfigMap that belongs to something else
+	owners := existing.GetOwnerReferences()
+	if len(owners) == 0 || owners[0].UID != report.GetUID() {
+		return fmt.Errorf("ConfigMap '%v' already exists and is not owned by the report", configmap.Name)
+	}
+
+	existing.Object["data"] = obj["data"]
+	_, err = resource.Update(ctx, existing, v1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,145 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	obcv1alpha1 "github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var EventGroupVersionResource = schema.GroupVersionResource{
+	Group:    "",
+	Version:  "v1",
+	Resource: "events",
+}
+
+// reasons of the events recorded on OBCs that fail to meter
+const (
+	ReasonMissingCredentials = "MissingCredentials"
+	ReasonMissingBucketInfo  = "MissingBucketInfo"
+	ReasonBucketListFailed   = "BucketListFailed"
+)
+
+const annotationPrefix = "obc-meter.io/"
+
+const component = "obc-meter"
+
+// recordFailureEvent records a Warning event on the OBC so tenants see it with kubectl describe obc.
+// An OBC has one event per reason, repeated failures bump its count like the kubelet's events do.
+func recordFailureEvent(claim *obcv1alpha1.ObjectBucketClaim, reason string, cause error) {
+	now := v1.NewTime(time.Now())
+	hostname, _ := os.Hostname()
+	message := "Failed to meter bucket: " + cause.Error()
+
+	event := corev1.Event{
+		TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "Event"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      failureEventName(claim, reason),
+			Namespace: claim.GetNamespace(),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      OBCGroupVersionResource.GroupVersion().String(),
+			Kind:            "ObjectBucketClaim",
+			Name:            claim.GetName(),
+			Namespace:       claim.GetNamespace(),
+			UID:             claim.GetUID(),
+			ResourceVersion: claim.GetResourceVersion(),
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                corev1.EventTypeWarning,
+		Source:              corev1.EventSource{Component: component},
+		ReportingController: component,
+		ReportingInstance:   hostname,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&event)
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to record event [Name=%v, Namespace=%v]\n", claim.GetName(), claim.GetNamespace())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resource := client.Resource(EventGroupVersionResource).Namespace(claim.GetNamespace())
+
+	existing, err := resource.Get(ctx, event.Name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = resource.Create(ctx, &unstructured.Unstructured{Object: obj}, v1.CreateOptions{})
+	} else if err == nil {
+		count, _, _ := unstructured.NestedInt64(existing.Object, "count")
+		existing.Object["count"] = count + 1
+		existing.Object["lastTimestamp"] = obj["lastTimestamp"]
+		existing.Object["message"] = message
+		existing.Object["reportingInstance"] = hostname
+
+		// a conflicting update comes from another process recording the same failure
+		_, err = resource.Update(ctx, existing, v1.UpdateOptions{})
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to record event [Name=%v, Namespace=%v]\n", claim.GetName(), claim.GetNamespace())
+	}
+}
+
+// failureEventName is stable per OBC and reason, a recreated OBC gets new events
+func failureEventName(claim *obcv1alpha1.ObjectBucketClaim, reason string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(string(claim.GetUID()) + "/" + reason))
+
+	return fmt.Sprintf("%v.%x", claim.GetName(), hash.Sum64())
+}
+
+func annotationsEnabled() bool {
+	return utils.GetConfig().Metering.Annotations
+}
+
+// annotateUsage patches the OBC with the time it was last metered and its current usage
+func annotateUsage(claim *obcv1alpha1.ObjectBucketClaim, bytesTotal uint64, objectsCount uint64) {
+	if !annotationsEnabled() {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				annotationPrefix + "last-metered":  time.Now().UTC().Format(time.RFC3339),
+				annotationPrefix + "bytes-total":   strconv.FormatUint(bytesTotal, 10),
+				annotationPrefix + "objects-count": strconv.FormatUint(objectsCount, 10),
+			},
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = client.Resource(OBCGroupVersionResource).Namespace(claim.GetNamespace()).Patch(ctx, claim.GetName(), types.MergePatchType, patch, v1.PatchOptions{})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to annotate bucket [Name=%v, Namespace=%v]\n", claim.GetName(), claim.GetNamespace())
+	}
+}
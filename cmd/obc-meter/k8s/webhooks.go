@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/webhook"
+)
+
+func emitRunEvent(eventType string, runId int) {
+	if !webhook.IsConfigured() {
+		return
+	}
+
+	runs, err := db.GetRuns(db.GetRunsArgs{Ids: &[]string{strconv.Itoa(runId)}})
+	if err != nil || len(*runs) < 1 {
+		fmt.Println(err)
+		log.Printf("Failed to emit '%v' event for run '%v'\n", eventType, runId)
+		return
+	}
+
+	webhook.Emit(eventType, "runs/"+strconv.Itoa(runId), (*runs)[0])
+}
+
+func emitBucketEvents(eventType string, uids []string) {
+	if len(uids) == 0 || !webhook.IsConfigured() {
+		return
+	}
+
+	buckets, err := db.GetBuckets(db.GetBucketsArgs{Uids: &uids})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to emit '%v' events\n", eventType)
+		return
+	}
+
+	for _, bucket := range *buckets {
+		webhook.Emit(eventType, "buckets/"+bucket.Uid, bucket)
+	}
+}
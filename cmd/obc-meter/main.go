@@ -1,13 +1,25 @@
 package main
 
 import (
+	"os"
+
 	"github.com/fallmo/obc-meter/cmd/obc-meter/api"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/cli"
 	"github.com/fallmo/obc-meter/cmd/obc-meter/k8s"
 	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/webhook"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		cli.Run(os.Args[1:])
+		return
+	}
+
 	utils.StartupTasks()
+	go webhook.StartRedelivery()
 	k8s.StartMeteringObjectBuckets()
+	go k8s.StartScheduler()
+	go k8s.StartReconcilingReports()
 	api.StartServer()
 }
@@ -0,0 +1,44 @@
+package pricing
+
+import (
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+)
+
+// hours in an average month, used to convert GiB-hours into GiB-months
+const HoursPerMonth = 730
+
+const bytesPerGiB = 1024 * 1024 * 1024
+
+// pricing is enabled by pricing.pricePerGiBMonth, the list price of storing one GiB for one month
+func IsConfigured() bool {
+	return utils.GetConfig().Pricing.PricePerGiBMonth != nil
+}
+
+func PricePerGiBMonth() float64 {
+	price := utils.GetConfig().Pricing.PricePerGiBMonth
+	if price == nil {
+		return 0
+	}
+
+	return *price
+}
+
+func Currency() string {
+	return utils.GetConfig().Pricing.Currency
+}
+
+// storage consumed by keeping bytesTotal for the given duration
+func GiBHours(bytesTotal uint64, duration time.Duration) float64 {
+	return float64(bytesTotal) / bytesPerGiB * duration.Hours()
+}
+
+func GiBMonths(bytesTotal uint64, duration time.Duration) float64 {
+	return GiBHours(bytesTotal, duration) / HoursPerMonth
+}
+
+// rated cost of keeping bytesTotal for the given duration, 0 when pricing is not configured
+func Cost(bytesTotal uint64, duration time.Duration) float64 {
+	return GiBMonths(bytesTotal, duration) * PricePerGiBMonth()
+}
@@ -0,0 +1,204 @@
+// Only plain series selectors of PromQL are supported, e.g.
+// obc_meter_bucket_bytes{namespace="team-a", storage_class=~"ocs-.*"}
+package prom
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Matcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+type Selector []Matcher
+
+func (m Matcher) matches(value string) bool {
+	switch m.Op {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+// Matches reports whether a series with the given labels (including __name__) is selected
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, m := range s {
+		if !m.matches(labels[m.Name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ParseSelector(input string) (Selector, error) {
+	p := parser{input: strings.TrimSpace(input)}
+	selector := Selector{}
+
+	name := p.identifier()
+	if name != "" {
+		selector = append(selector, Matcher{Name: "__name__", Op: "=", Value: name})
+	}
+
+	p.skipSpaces()
+	if p.peek() == '{' {
+		p.pos++
+		for {
+			p.skipSpaces()
+			if p.peek() == '}' {
+				p.pos++
+				break
+			}
+
+			matcher, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			selector = append(selector, *matcher)
+
+			p.skipSpaces()
+			if p.peek() == ',' {
+				p.pos++
+			} else if p.peek() != '}' {
+				return nil, p.parseError("expected ',' or '}'")
+			}
+		}
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, p.parseError("unsupported expression, only series selectors are supported")
+	}
+
+	if len(selector) == 0 {
+		return nil, errors.New("empty selector")
+	}
+
+	return selector, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+
+	return 0
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\n\r", rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *parser) identifier() string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		isLetter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && p.pos > start) {
+			break
+		}
+		p.pos++
+	}
+
+	return p.input[start:p.pos]
+}
+
+func (p *parser) matcher() (*Matcher, error) {
+	name := p.identifier()
+	if name == "" {
+		return nil, p.parseError("expected label name")
+	}
+
+	p.skipSpaces()
+	op := ""
+	for _, candidate := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(p.input[p.pos:], candidate) {
+			op = candidate
+			break
+		}
+	}
+
+	if op == "" {
+		return nil, p.parseError("expected one of '=', '!=', '=~', '!~'")
+	}
+	p.pos += len(op)
+
+	p.skipSpaces()
+	value, err := p.stringLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := Matcher{Name: name, Op: op, Value: value}
+
+	if op == "=~" || op == "!~" {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		matcher.re = re
+	}
+
+	return &matcher, nil
+}
+
+func (p *parser) stringLiteral() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.parseError("expected quoted label value")
+	}
+	p.pos++
+
+	var value strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+
+		if c == quote {
+			return value.String(), nil
+		}
+
+		if c == '\\' && quote != '`' && p.pos < len(p.input) {
+			escaped := p.input[p.pos]
+			p.pos++
+			switch escaped {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(escaped)
+			}
+			continue
+		}
+
+		value.WriteByte(c)
+	}
+
+	return "", p.parseError("unterminated label value")
+}
+
+func (p *parser) parseError(message string) error {
+	return errors.New("parse error at char " + strconv.Itoa(p.pos+1) + ": " + message)
+}
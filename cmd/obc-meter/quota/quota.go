@@ -0,0 +1,112 @@
+// Quotas come from the OBC's spec.additionalConfig maxSize and maxObjects. An event is raised
+// when utilisation reaches a threshold and stays open until utilisation drops below it again.
+package quota
+
+import (
+	"log"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+)
+
+const (
+	KindSize    = "size"
+	KindObjects = "objects"
+)
+
+var Kinds = []string{KindSize, KindObjects}
+
+// percentages of the quota, sorted
+func Thresholds() []int {
+	return utils.GetConfig().Quotas.Thresholds
+}
+
+// Utilisation in percent, nil when there is no quota
+func Utilisation(value uint64, quota *uint64) *float64 {
+	if quota == nil || *quota == 0 {
+		return nil
+	}
+
+	utilisation := float64(value) / float64(*quota) * 100
+	return &utilisation
+}
+
+type EvaluateArgs struct {
+	BucketUid    string
+	RunId        int
+	MaxSize      *uint64
+	MaxObjects   *uint64
+	BytesTotal   uint64
+	ObjectsCount uint64
+}
+
+// Evaluate raises events for newly reached thresholds and resolves the ones no longer reached
+func Evaluate(args EvaluateArgs) ([]db.QuotaEvent, error) {
+	raised := []db.QuotaEvent{}
+
+	checks := []struct {
+		kind  string
+		quota *uint64
+		value uint64
+	}{
+		{KindSize, args.MaxSize, args.BytesTotal},
+		{KindObjects, args.MaxObjects, args.ObjectsCount},
+	}
+
+	for _, check := range checks {
+		utilisation := Utilisation(check.value, check.quota)
+
+		// quota removed, nothing stays open
+		if utilisation == nil {
+			err := db.ResolveQuotaEvents(args.BucketUid, check.kind, -1)
+			if err != nil {
+				return raised, err
+			}
+			continue
+		}
+
+		err := db.ResolveQuotaEvents(args.BucketUid, check.kind, *utilisation)
+		if err != nil {
+			return raised, err
+		}
+
+		open := true
+		openEvents, err := db.GetQuotaEvents(db.GetQuotaEventsArgs{
+			Uids:  &[]string{args.BucketUid},
+			Kinds: &[]string{check.kind},
+			Open:  &open,
+		})
+		if err != nil {
+			return raised, err
+		}
+
+		alreadyRaised := map[int]bool{}
+		for _, event := range *openEvents {
+			alreadyRaised[event.Threshold] = true
+		}
+
+		for _, threshold := range Thresholds() {
+			if *utilisation < float64(threshold) || alreadyRaised[threshold] {
+				continue
+			}
+
+			event, err := db.RaiseQuotaEvent(db.QuotaEvent{
+				BucketUid:   args.BucketUid,
+				RunId:       args.RunId,
+				Kind:        check.kind,
+				Threshold:   threshold,
+				Quota:       *check.quota,
+				Value:       check.value,
+				Utilisation: *utilisation,
+			})
+			if err != nil {
+				return raised, err
+			}
+
+			log.Printf("Bucket reached %v%% of its %v quota (%v/%v) [Uid=%v]\n", threshold, check.kind, check.value, *check.quota, args.BucketUid)
+			raised = append(raised, *event)
+		}
+	}
+
+	return raised, nil
+}
@@ -0,0 +1,207 @@
+package usage
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+type ForecastArgs struct {
+	// buckets whose usage is summed and forecast together
+	Uids []string
+	// bytes or objects
+	Metric string
+	// linear, or seasonal (linear trend plus a repeating pattern of length Season)
+	Model   string
+	History time.Duration
+	Step    time.Duration
+	Season  time.Duration
+	Horizon time.Duration
+	// optional, predict the value at this time
+	At *time.Time
+	// optional, find when the forecast first reaches this value
+	Threshold *float64
+}
+
+type Forecast struct {
+	Metric      string    `json:"metric"`
+	Model       string    `json:"model"`
+	HistoryFrom time.Time `json:"history_from"`
+	HistoryTo   time.Time `json:"history_to"`
+	Samples     int       `json:"samples"`
+	Current     float64   `json:"current"`
+	// trend growth per day
+	SlopePerDay float64 `json:"slope_per_day"`
+	// seasonal offsets added to the trend, one per step of the season
+	Seasonal []float64 `json:"seasonal,omitempty"`
+
+	Prediction *Sample `json:"prediction"`
+
+	Threshold *float64 `json:"threshold"`
+	// true when the last observed value already reached the threshold
+	ThresholdExceeded bool `json:"threshold_exceeded"`
+	// nil when the threshold is not reached within the horizon
+	ThresholdCrossedAt *time.Time `json:"threshold_crossed_at"`
+}
+
+var ForecastModels = []string{"linear", "seasonal"}
+
+var ErrNotEnoughHistory = errors.New("not enough usage history to forecast, at least two steps are required")
+var ErrNotEnoughSeasons = errors.New("seasonal forecasts need at least two full seasons of history")
+
+func GetForecast(args ForecastArgs) (*Forecast, error) {
+	value := Bytes
+	if args.Metric == "objects" {
+		value = Objects
+	}
+
+	to := time.Now()
+	from := to.Add(-args.History)
+
+	records, err := db.GetUsageRecords(db.GetRecordsArgs{Uids: &args.Uids, FromPeriod: &from, ToPeriod: &to})
+	if err != nil {
+		return nil, err
+	}
+
+	samples := Aggregate(*records, from, to, args.Step, value)
+	if len(samples) < 2 {
+		return nil, ErrNotEnoughHistory
+	}
+
+	forecast := Forecast{
+		Metric:      args.Metric,
+		Model:       args.Model,
+		HistoryFrom: from,
+		HistoryTo:   to,
+		Samples:     len(samples),
+		Current:     samples[len(samples)-1].Value,
+		Threshold:   args.Threshold,
+	}
+
+	origin := samples[0].Time
+	xs := []float64{}
+	ys := []float64{}
+	for _, sample := range samples {
+		xs = append(xs, sample.Time.Sub(origin).Hours()/24)
+		ys = append(ys, sample.Value)
+	}
+
+	slope, intercept := linearRegression(xs, ys)
+	forecast.SlopePerDay = slope
+
+	seasonSteps := 0
+	if args.Model == "seasonal" {
+		seasonSteps = int(args.Season / args.Step)
+		if seasonSteps < 2 || len(samples) < 2*seasonSteps {
+			return nil, ErrNotEnoughSeasons
+		}
+
+		// average residual from the trend at each position of the season
+		sums := make([]float64, seasonSteps)
+		counts := make([]float64, seasonSteps)
+		for i, sample := range samples {
+			position := seasonPosition(sample.Time, origin, args.Step, seasonSteps)
+			sums[position] += sample.Value - (intercept + slope*xs[i])
+			counts[position]++
+		}
+
+		forecast.Seasonal = make([]float64, seasonSteps)
+		for i := range sums {
+			if counts[i] > 0 {
+				forecast.Seasonal[i] = sums[i] / counts[i]
+			}
+		}
+	}
+
+	predict := func(t time.Time) float64 {
+		prediction := intercept + slope*t.Sub(origin).Hours()/24
+		if seasonSteps > 0 {
+			prediction += forecast.Seasonal[seasonPosition(t, origin, args.Step, seasonSteps)]
+		}
+
+		return math.Max(prediction, 0)
+	}
+
+	if args.At != nil {
+		forecast.Prediction = &Sample{Time: *args.At, Value: predict(*args.At)}
+	}
+
+	if args.Threshold != nil {
+		if forecast.Current >= *args.Threshold {
+			forecast.ThresholdExceeded = true
+		} else {
+			last := samples[len(samples)-1].Time
+			for t := last.Add(args.Step); !t.After(last.Add(args.Horizon)); t = t.Add(args.Step) {
+				if predict(t) >= *args.Threshold {
+					crossedAt := t
+					forecast.ThresholdCrossedAt = &crossedAt
+					break
+				}
+			}
+		}
+	}
+
+	return &forecast, nil
+}
+
+// Aggregate sums the resampled usage of every bucket in the records at each step
+func Aggregate(records []db.Record, start time.Time, end time.Time, step time.Duration, value ValueFunc) []Sample {
+	totals := map[int64]*Sample{}
+
+	for _, bucketRecords := range GroupByBucket(records) {
+		for _, sample := range Resample(bucketRecords, start, end, step, value) {
+			total, ok := totals[sample.Time.UnixNano()]
+			if !ok {
+				total = &Sample{Time: sample.Time}
+				totals[sample.Time.UnixNano()] = total
+			}
+			total.Value += sample.Value
+		}
+	}
+
+	samples := []Sample{}
+	for _, total := range totals {
+		samples = append(samples, *total)
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+
+	return samples
+}
+
+// least squares fit of y = intercept + slope * x
+func linearRegression(xs []float64, ys []float64) (float64, float64) {
+	n := float64(len(xs))
+	var sumX, sumY, sumXY, sumXX float64
+
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, sumY / n
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+
+	return slope, intercept
+}
+
+func seasonPosition(t time.Time, origin time.Time, step time.Duration, seasonSteps int) int {
+	position := int(math.Round(float64(t.Sub(origin))/float64(step))) % seasonSteps
+	if position < 0 {
+		position += seasonSteps
+	}
+
+	return position
+}
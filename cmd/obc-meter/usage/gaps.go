@@ -0,0 +1,306 @@
+package usage
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+// A gap is an interval without a successful observation of a bucket: the time between two
+// observations further apart than the maximum interval, or with a run that failed the bucket in
+// between, and the time since the last observation when it is as old. Usage in a gap is estimated.
+// Opening a record counts as an observation, so buckets are analysed from their first record.
+
+type Gap struct {
+	BucketUid string    `json:"bucket_uid"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	// runs that failed to meter the bucket during the gap
+	FailedRunIds []int `json:"failed_run_ids"`
+	// no observation since, the gap lasts until the end of the queried period
+	Open bool `json:"open"`
+}
+
+type FindGapsArgs struct {
+	Uids *[]string
+	From time.Time
+	To   time.Time
+	// observations further apart than this leave a gap between them
+	MaxInterval time.Duration
+}
+
+// FindGaps returns the gaps overlapping the period, ordered by bucket then time. Gaps are not
+// clipped to the period, open gaps last until its end.
+func FindGaps(args FindGapsArgs) ([]Gap, error) {
+	observations, err := db.GetObservations(db.GetObservationsArgs{Uids: args.Uids, FromPeriod: args.From, ToPeriod: args.To})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(observations) == 0 {
+		return []Gap{}, nil
+	}
+
+	earliest := args.From
+	uids := []string{}
+	for _, observation := range observations {
+		if observation.ObservedEnd.Before(earliest) {
+			earliest = observation.ObservedEnd
+		}
+
+		if !slices.Contains(uids, observation.BucketUid) {
+			uids = append(uids, observation.BucketUid)
+		}
+	}
+
+	runs, err := db.GetRuns(db.GetRunsArgs{FromTime: &earliest, ToTime: &args.To})
+	if err != nil {
+		return nil, err
+	}
+
+	// the last record of a removed bucket is closed at its removal
+	recordEnds, err := db.GetLastRecordEnds(uids)
+	if err != nil {
+		return nil, err
+	}
+
+	return findGaps(observations, *runs, recordEnds, args), nil
+}
+
+// findGaps does the analysis of FindGaps on observations ordered by bucket, recordEnds holding
+// the end of the buckets whose last record is closed
+func findGaps(observations []db.Observation, runs []db.Run, recordEnds map[string]time.Time, args FindGapsArgs) []Gap {
+	uids := []string{}
+	grouped := map[string][]db.Observation{}
+	for _, observation := range observations {
+		if _, ok := grouped[observation.BucketUid]; !ok {
+			uids = append(uids, observation.BucketUid)
+		}
+		grouped[observation.BucketUid] = append(grouped[observation.BucketUid], observation)
+	}
+
+	gaps := []Gap{}
+	for _, uid := range uids {
+		bucketObservations := grouped[uid]
+		sort.SliceStable(bucketObservations, func(i, j int) bool {
+			return bucketObservations[i].ObservedStart.Before(bucketObservations[j].ObservedStart)
+		})
+
+		// observations can overlap, a gap starts once every earlier one ended
+		var observedUntil time.Time
+
+		for i, observation := range bucketObservations {
+			if observation.ObservedEnd.After(observedUntil) {
+				observedUntil = observation.ObservedEnd
+			}
+
+			gap := Gap{BucketUid: uid, From: observedUntil}
+
+			if i+1 < len(bucketObservations) {
+				gap.To = bucketObservations[i+1].ObservedStart
+			} else {
+				gap.To = args.To
+				gap.Open = true
+
+				// nothing to observe once the bucket's records end
+				if end, ok := recordEnds[uid]; ok && end.Before(gap.To) {
+					gap.To = end
+					gap.Open = false
+				}
+			}
+
+			if !gap.From.Before(gap.To) {
+				continue
+			}
+
+			gap.FailedRunIds = failedRuns(runs, uid, gap.From, gap.To)
+			if gap.To.Sub(gap.From) <= args.MaxInterval && len(gap.FailedRunIds) == 0 {
+				continue
+			}
+
+			if gap.To.After(args.From) {
+				gaps = append(gaps, gap)
+			}
+		}
+	}
+
+	return gaps
+}
+
+func failedRuns(runs []db.Run, uid string, from time.Time, to time.Time) []int {
+	ids := []int{}
+	for _, run := range runs {
+		if run.StartTime.After(from) && run.StartTime.Before(to) && slices.Contains(run.FailedUids, uid) {
+			ids = append(ids, run.ID)
+		}
+	}
+
+	sort.Ints(ids)
+	return ids
+}
+
+// MarkEstimated splits records at gap boundaries and marks the parts within gaps as estimated,
+// parts keep the id of their record. With db.FillExclude the estimated parts are left out.
+// Open records are in effect until end.
+func MarkEstimated(records []db.Record, gaps []Gap, end time.Time, fill string) []db.Record {
+	bucketGaps := map[string][]Gap{}
+	for _, gap := range gaps {
+		bucketGaps[gap.BucketUid] = append(bucketGaps[gap.BucketUid], gap)
+	}
+
+	marked := []db.Record{}
+	for _, record := range records {
+		from := record.PeriodStart
+		to := recordEnd(record, end)
+
+		parts := []db.Record{}
+		for _, gap := range bucketGaps[record.BucketUid] {
+			if !gap.To.After(from) || !gap.From.Before(to) {
+				continue
+			}
+
+			if gap.From.After(from) {
+				parts = append(parts, recordPart(record, from, gap.From, to))
+			}
+
+			estimatedEnd := minTime(gap.To, to)
+			estimated := recordPart(record, maxTime(gap.From, from), estimatedEnd, to)
+			estimated.Estimated = true
+			parts = append(parts, estimated)
+
+			from = estimatedEnd
+		}
+
+		if len(parts) == 0 {
+			marked = append(marked, record)
+			continue
+		}
+
+		if from.Before(to) {
+			parts = append(parts, recordPart(record, from, to, to))
+		}
+
+		for _, part := range parts {
+			if fill == db.FillExclude && part.Estimated {
+				continue
+			}
+			marked = append(marked, part)
+		}
+	}
+
+	return marked
+}
+
+// FlagEstimated marks the records overlapping a gap as estimated without splitting them, open
+// records are in effect until end
+func FlagEstimated(records []db.Record, gaps []Gap, end time.Time) []db.Record {
+	bucketGaps := map[string][]Gap{}
+	for _, gap := range gaps {
+		bucketGaps[gap.BucketUid] = append(bucketGaps[gap.BucketUid], gap)
+	}
+
+	flagged := []db.Record{}
+	for _, record := range records {
+		for _, gap := range bucketGaps[record.BucketUid] {
+			if gap.To.After(record.PeriodStart) && gap.From.Before(recordEnd(record, end)) {
+				record.Estimated = true
+				break
+			}
+		}
+
+		flagged = append(flagged, record)
+	}
+
+	return flagged
+}
+
+// recordPart is the record limited to from and to, still open when it runs to the end of an open record
+func recordPart(record db.Record, from time.Time, to time.Time, end time.Time) db.Record {
+	part := record
+	part.PeriodStart = from
+
+	if record.PeriodEnd != nil || to.Before(end) {
+		partEnd := to
+		part.PeriodEnd = &partEnd
+	}
+
+	return part
+}
+
+// InterpolateSteps replaces the values of estimated steps that start within a gap with the
+// linear interpolation between the value before the gap and the value observed after it.
+// Records are the unsplit records of the series. Open gaps, and gaps ending after the
+// records do, keep their carried value.
+func InterpolateSteps(series []Series, records []db.Record, gaps []Gap, step time.Duration) []Series {
+	grouped := GroupByBucket(records)
+
+	bucketGaps := map[string][]Gap{}
+	for _, gap := range gaps {
+		if !gap.Open {
+			bucketGaps[gap.BucketUid] = append(bucketGaps[gap.BucketUid], gap)
+		}
+	}
+
+	for i := range series {
+		bucketRecords := grouped[series[i].BucketUid]
+
+		for j := range series[i].Steps {
+			current := &series[i].Steps[j]
+			if !current.Estimated {
+				continue
+			}
+
+			for _, gap := range bucketGaps[series[i].BucketUid] {
+				if current.Time.Before(gap.From) || !current.Time.Before(gap.To) {
+					continue
+				}
+
+				// no observation within the gap, the record in effect holds the value before it
+				before := recordAt(bucketRecords, current.Time)
+				after := recordAt(bucketRecords, gap.To)
+				if before == nil || after == nil {
+					break
+				}
+
+				at := func(t time.Time, value ValueFunc) float64 {
+					ratio := t.Sub(gap.From).Seconds() / gap.To.Sub(gap.From).Seconds()
+					return value(*before) + (value(*after)-value(*before))*ratio
+				}
+
+				stepEnd := minTime(current.Time.Add(step), gap.To)
+				middle := current.Time.Add(stepEnd.Sub(current.Time) / 2)
+
+				current.BytesTotal = uint64(at(current.Time, Bytes))
+				current.ObjectsCount = uint64(at(current.Time, Objects))
+				current.BytesAvg = at(middle, Bytes)
+				current.ObjectsAvg = at(middle, Objects)
+				current.BytesMin = uint64(min(at(current.Time, Bytes), at(stepEnd, Bytes)))
+				current.BytesMax = uint64(max(at(current.Time, Bytes), at(stepEnd, Bytes)))
+				current.ObjectsMin = uint64(min(at(current.Time, Objects), at(stepEnd, Objects)))
+				current.ObjectsMax = uint64(max(at(current.Time, Objects), at(stepEnd, Objects)))
+				break
+			}
+		}
+	}
+
+	return series
+}
+
+// recordAt returns the record in effect at t, records sorted by period start
+func recordAt(records []db.Record, t time.Time) *db.Record {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].PeriodStart.After(t) {
+			continue
+		}
+
+		if records[i].PeriodEnd == nil || records[i].PeriodEnd.After(t) {
+			return &records[i]
+		}
+
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package usage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+var t0 = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(hours int) time.Time {
+	return t0.Add(time.Duration(hours) * time.Hour)
+}
+
+func atPtr(hours int) *time.Time {
+	t := at(hours)
+	return &t
+}
+
+func observation(uid string, start int, end int) db.Observation {
+	return db.Observation{BucketUid: uid, ObservedStart: at(start), ObservedEnd: at(end)}
+}
+
+func TestFindGaps(t *testing.T) {
+	args := FindGapsArgs{From: at(0), To: at(100), MaxInterval: 24 * time.Hour}
+
+	tests := []struct {
+		name         string
+		observations []db.Observation
+		runs         []db.Run
+		recordEnds   map[string]time.Time
+		want         []Gap
+	}{
+		{
+			name:         "observations within the maximum interval",
+			observations: []db.Observation{observation("a", 0, 1), observation("a", 20, 21), observation("a", 40, 41), observation("a", 90, 91)},
+			want:         []Gap{{BucketUid: "a", From: at(41), To: at(90), FailedRunIds: []int{}}},
+		},
+		{
+			name:         "failed run between close observations",
+			observations: []db.Observation{observation("a", 0, 1), observation("a", 10, 11), observation("a", 90, 91)},
+			runs:         []db.Run{{ID: 7, StartTime: at(5), FailedUids: []string{"a"}}, {ID: 8, StartTime: at(6), FailedUids: []string{"b"}}},
+			want: []Gap{
+				{BucketUid: "a", From: at(1), To: at(10), FailedRunIds: []int{7}},
+				{BucketUid: "a", From: at(11), To: at(90), FailedRunIds: []int{}},
+			},
+		},
+		{
+			name:         "legacy record failing every run since",
+			observations: []db.Observation{observation("a", -10, -10)},
+			runs:         []db.Run{{ID: 3, StartTime: at(10), FailedUids: []string{"a"}}, {ID: 4, StartTime: at(20), FailedUids: []string{"a"}}},
+			want:         []Gap{{BucketUid: "a", From: at(-10), To: at(100), FailedRunIds: []int{3, 4}, Open: true}},
+		},
+		{
+			name:         "overlapping observations",
+			observations: []db.Observation{observation("a", 0, 50), observation("a", 10, 11), observation("a", 60, 99)},
+			want:         []Gap{},
+		},
+		{
+			name:         "records closed at removal",
+			observations: []db.Observation{observation("a", 0, 1), observation("b", 0, 1)},
+			recordEnds:   map[string]time.Time{"a": at(50)},
+			want: []Gap{
+				{BucketUid: "a", From: at(1), To: at(50), FailedRunIds: []int{}},
+				{BucketUid: "b", From: at(1), To: at(100), FailedRunIds: []int{}, Open: true},
+			},
+		},
+		{
+			name:         "gap ending before the period",
+			observations: []db.Observation{observation("a", -100, -99), observation("a", -10, -9), observation("a", 10, 11), observation("a", 99, 99)},
+			want:         []Gap{{BucketUid: "a", From: at(11), To: at(99), FailedRunIds: []int{}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := findGaps(test.observations, test.runs, test.recordEnds, args)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findGaps() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+type part struct {
+	start     time.Time
+	end       *time.Time
+	estimated bool
+}
+
+func TestMarkEstimated(t *testing.T) {
+	closed := db.Record{ID: 1, BucketUid: "a", PeriodStart: at(0), PeriodEnd: atPtr(100), BytesTotal: 10}
+	open := db.Record{ID: 2, BucketUid: "a", PeriodStart: at(0), BytesTotal: 10}
+
+	tests := []struct {
+		name   string
+		record db.Record
+		gaps   []Gap
+		fill   string
+		want   []part
+	}{
+		{
+			name:   "no gap",
+			record: closed,
+			gaps:   []Gap{{BucketUid: "b", From: at(10), To: at(20)}},
+			fill:   db.FillCarryForward,
+			want:   []part{{at(0), atPtr(100), false}},
+		},
+		{
+			name:   "gap within the record",
+			record: closed,
+			gaps:   []Gap{{BucketUid: "a", From: at(10), To: at(20)}},
+			fill:   db.FillCarryForward,
+			want:   []part{{at(0), atPtr(10), false}, {at(10), atPtr(20), true}, {at(20), atPtr(100), false}},
+		},
+		{
+			name:   "gaps across the record's bounds",
+			record: closed,
+			gaps:   []Gap{{BucketUid: "a", From: at(-10), To: at(10)}, {BucketUid: "a", From: at(90), To: at(110)}},
+			fill:   db.FillCarryForward,
+			want:   []part{{at(0), atPtr(10), true}, {at(10), atPtr(90), false}, {at(90), atPtr(100), true}},
+		},
+		{
+			name:   "exclude fill",
+			record: closed,
+			gaps:   []Gap{{BucketUid: "a", From: at(10), To: at(20)}, {BucketUid: "a", From: at(90), To: at(110)}},
+			fill:   db.FillExclude,
+			want:   []part{{at(0), atPtr(10), false}, {at(20), atPtr(90), false}},
+		},
+		{
+			name:   "open gap of an open record",
+			record: open,
+			gaps:   []Gap{{BucketUid: "a", From: at(50), To: at(200), Open: true}},
+			fill:   db.FillCarryForward,
+			want:   []part{{at(0), atPtr(50), false}, {at(50), nil, true}},
+		},
+		{
+			name:   "closed gap of an open record",
+			record: open,
+			gaps:   []Gap{{BucketUid: "a", From: at(50), To: at(60)}},
+			fill:   db.FillCarryForward,
+			want:   []part{{at(0), atPtr(50), false}, {at(50), atPtr(60), true}, {at(60), nil, false}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			marked := MarkEstimated([]db.Record{test.record}, test.gaps, at(200), test.fill)
+
+			got := []part{}
+			for _, record := range marked {
+				if record.ID != test.record.ID || record.BytesTotal != test.record.BytesTotal {
+					t.Errorf("part %+v does not keep the record's id and values", record)
+				}
+				got = append(got, part{record.PeriodStart, record.PeriodEnd, record.Estimated})
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("MarkEstimated() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlagEstimated(t *testing.T) {
+	records := []db.Record{
+		{ID: 1, BucketUid: "a", PeriodStart: at(0), PeriodEnd: atPtr(10)},
+		{ID: 2, BucketUid: "a", PeriodStart: at(10), PeriodEnd: atPtr(20)},
+		{ID: 3, BucketUid: "a", PeriodStart: at(20)},
+		{ID: 4, BucketUid: "b", PeriodStart: at(0)},
+	}
+
+	tests := []struct {
+		name string
+		gaps []Gap
+		want []bool
+	}{
+		{"no gap", []Gap{}, []bool{false, false, false, false}},
+		{"gap within a record", []Gap{{BucketUid: "a", From: at(12), To: at(15)}}, []bool{false, true, false, false}},
+		{"gap across records", []Gap{{BucketUid: "a", From: at(5), To: at(25)}}, []bool{true, true, true, false}},
+		{"gap touching a record", []Gap{{BucketUid: "a", From: at(10), To: at(20)}}, []bool{false, true, false, false}},
+		{"open gap of an open record", []Gap{{BucketUid: "b", From: at(50), To: at(200), Open: true}}, []bool{false, false, false, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flagged := FlagEstimated(records, test.gaps, at(100))
+
+			got := []bool{}
+			for i, record := range flagged {
+				if record.ID != records[i].ID || !record.PeriodStart.Equal(records[i].PeriodStart) {
+					t.Errorf("record %+v was changed beyond its flag", record)
+				}
+				got = append(got, record.Estimated)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("FlagEstimated() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInterpolateSteps(t *testing.T) {
+	records := []db.Record{
+		{ID: 1, BucketUid: "a", PeriodStart: at(0), PeriodEnd: atPtr(40), BytesTotal: 100, ObjectsCount: 10},
+		{ID: 2, BucketUid: "a", PeriodStart: at(40), BytesTotal: 500, ObjectsCount: 50},
+	}
+
+	tests := []struct {
+		name string
+		gaps []Gap
+		// bytes of the steps starting every 10 hours
+		want []uint64
+	}{
+		{
+			name: "closed gap",
+			gaps: []Gap{{BucketUid: "a", From: at(0), To: at(40)}},
+			want: []uint64{100, 200, 300, 400, 500, 500},
+		},
+		{
+			name: "open gap keeps the carried value",
+			gaps: []Gap{{BucketUid: "a", From: at(40), To: at(60), Open: true}},
+			want: []uint64{100, 100, 100, 100, 500, 500},
+		},
+		{
+			name: "gap ending after the records",
+			gaps: []Gap{{BucketUid: "a", From: at(40), To: at(80)}},
+			want: []uint64{100, 100, 100, 100, 500, 500},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			end := at(60)
+			marked := MarkEstimated(records, test.gaps, end, db.FillInterpolate)
+			series := InterpolateSteps(ResampleSteps(marked, at(0), end, 10*time.Hour), records, test.gaps, 10*time.Hour)
+
+			if len(series) != 1 {
+				t.Fatalf("got %v series, want 1", len(series))
+			}
+
+			got := []uint64{}
+			for _, step := range series[0].Steps {
+				got = append(got, step.BytesTotal)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("InterpolateSteps() bytes = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordPart(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  db.Record
+		from    int
+		to      int
+		wantEnd *time.Time
+	}{
+		{"closed record", db.Record{PeriodStart: at(0), PeriodEnd: atPtr(100)}, 10, 100, atPtr(100)},
+		{"open record before its end", db.Record{PeriodStart: at(0)}, 10, 50, atPtr(50)},
+		{"open record to its end", db.Record{PeriodStart: at(0)}, 10, 100, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := recordPart(test.record, at(test.from), at(test.to), at(100))
+
+			if !got.PeriodStart.Equal(at(test.from)) {
+				t.Errorf("recordPart() start = %v, want %v", got.PeriodStart, at(test.from))
+			}
+
+			if !reflect.DeepEqual(got.PeriodEnd, test.wantEnd) {
+				t.Errorf("recordPart() end = %v, want %v", got.PeriodEnd, test.wantEnd)
+			}
+		})
+	}
+}
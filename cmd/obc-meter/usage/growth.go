@@ -0,0 +1,193 @@
+package usage
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+type GrowthItem struct {
+	// bucket uid, namespace or account depending on the grouping
+	Key    string     `json:"key"`
+	Bucket *db.Bucket `json:"bucket,omitempty"`
+
+	Buckets            int      `json:"buckets"`
+	BytesFrom          uint64   `json:"bytes_from"`
+	BytesTo            uint64   `json:"bytes_to"`
+	BytesGrowth        int64    `json:"bytes_growth"`
+	BytesGrowthRatio   *float64 `json:"bytes_growth_ratio"`
+	ObjectsFrom        uint64   `json:"objects_from"`
+	ObjectsTo          uint64   `json:"objects_to"`
+	ObjectsGrowth      int64    `json:"objects_growth"`
+	ObjectsGrowthRatio *float64 `json:"objects_growth_ratio"`
+}
+
+type GrowthReport struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	GroupBy string       `json:"group_by"`
+	SortBy  string       `json:"sort_by"`
+	Items   []GrowthItem `json:"items"`
+}
+
+type GrowthReportArgs struct {
+	From time.Time
+	To   time.Time
+	// bucket, namespace or account
+	GroupBy string
+	// bytes, bytes_ratio, objects or objects_ratio
+	SortBy string
+	Top    int
+}
+
+var GrowthGroupings = []string{"bucket", "namespace", "account"}
+var GrowthSortings = []string{"bytes", "bytes_ratio", "objects", "objects_ratio"}
+
+// GetGrowthReport compares the usage snapshots at From and To and ranks the groups by growth.
+// Buckets that did not exist (or were not metered yet) at one end count as empty.
+// Ratios are null when the group was empty at From and sort after every finite ratio.
+func GetGrowthReport(args GrowthReportArgs) (*GrowthReport, error) {
+	if !slices.Contains(GrowthGroupings, args.GroupBy) {
+		return nil, errors.New("group by must be one of bucket, namespace or account")
+	}
+
+	if !slices.Contains(GrowthSortings, args.SortBy) {
+		return nil, errors.New("sort by must be one of bytes, bytes_ratio, objects or objects_ratio")
+	}
+
+	before, err := db.GetUsageAt(db.GetUsageAtArgs{Time: args.From})
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := db.GetUsageAt(db.GetUsageAtArgs{Time: args.To})
+	if err != nil {
+		return nil, err
+	}
+
+	items := map[string]*GrowthItem{}
+	bucketsSeen := map[string]map[string]bool{}
+
+	add := func(bucketUsage db.BucketUsageAt, isAfter bool) {
+		key := growthKey(bucketUsage.Bucket, args.GroupBy)
+
+		item, ok := items[key]
+		if !ok {
+			item = &GrowthItem{Key: key}
+			if args.GroupBy == "bucket" {
+				bucket := bucketUsage.Bucket
+				item.Bucket = &bucket
+			}
+			items[key] = item
+			bucketsSeen[key] = map[string]bool{}
+		}
+
+		if !bucketsSeen[key][bucketUsage.Bucket.Uid] {
+			bucketsSeen[key][bucketUsage.Bucket.Uid] = true
+			item.Buckets++
+		}
+
+		if bucketUsage.Record == nil {
+			return
+		}
+
+		if isAfter {
+			item.BytesTo += bucketUsage.Record.BytesTotal
+			item.ObjectsTo += bucketUsage.Record.ObjectsCount
+		} else {
+			item.BytesFrom += bucketUsage.Record.BytesTotal
+			item.ObjectsFrom += bucketUsage.Record.ObjectsCount
+		}
+	}
+
+	for _, bucketUsage := range *before {
+		add(bucketUsage, false)
+	}
+
+	for _, bucketUsage := range *after {
+		add(bucketUsage, true)
+	}
+
+	report := GrowthReport{
+		From:    args.From,
+		To:      args.To,
+		GroupBy: args.GroupBy,
+		SortBy:  args.SortBy,
+		Items:   []GrowthItem{},
+	}
+
+	for _, item := range items {
+		item.BytesGrowth = int64(item.BytesTo) - int64(item.BytesFrom)
+		item.ObjectsGrowth = int64(item.ObjectsTo) - int64(item.ObjectsFrom)
+		item.BytesGrowthRatio = growthRatio(item.BytesFrom, item.BytesGrowth)
+		item.ObjectsGrowthRatio = growthRatio(item.ObjectsFrom, item.ObjectsGrowth)
+
+		report.Items = append(report.Items, *item)
+	}
+
+	sort.SliceStable(report.Items, func(i, j int) bool {
+		a := report.Items[i]
+		b := report.Items[j]
+
+		switch args.SortBy {
+		case "bytes_ratio":
+			return ratioGreater(a.BytesGrowthRatio, b.BytesGrowthRatio, a.Key < b.Key)
+		case "objects":
+			if a.ObjectsGrowth != b.ObjectsGrowth {
+				return a.ObjectsGrowth > b.ObjectsGrowth
+			}
+		case "objects_ratio":
+			return ratioGreater(a.ObjectsGrowthRatio, b.ObjectsGrowthRatio, a.Key < b.Key)
+		default:
+			if a.BytesGrowth != b.BytesGrowth {
+				return a.BytesGrowth > b.BytesGrowth
+			}
+		}
+
+		return a.Key < b.Key
+	})
+
+	if args.Top > 0 && len(report.Items) > args.Top {
+		report.Items = report.Items[:args.Top]
+	}
+
+	return &report, nil
+}
+
+func growthKey(bucket db.Bucket, groupBy string) string {
+	switch groupBy {
+	case "namespace":
+		return bucket.Namespace
+	case "account":
+		return bucket.Account
+	default:
+		return bucket.Uid
+	}
+}
+
+func growthRatio(from uint64, growth int64) *float64 {
+	if from == 0 {
+		return nil
+	}
+
+	ratio := float64(growth) / float64(from)
+	return &ratio
+}
+
+func ratioGreater(a *float64, b *float64, tieBreak bool) bool {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return tieBreak
+		}
+		return b == nil
+	}
+
+	if *a != *b {
+		return *a > *b
+	}
+
+	return tieBreak
+}
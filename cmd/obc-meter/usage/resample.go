@@ -0,0 +1,197 @@
+package usage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+// records only store the intervals between changes, resampling turns them into a
+// dense series with the value in effect at every step
+
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// value picks the field of the record to sample, e.g. bytes or objects
+type ValueFunc func(db.Record) float64
+
+func Bytes(record db.Record) float64 {
+	return float64(record.BytesTotal)
+}
+
+func Objects(record db.Record) float64 {
+	return float64(record.ObjectsCount)
+}
+
+// GroupByBucket splits records per bucket uid, each sorted by period start
+func GroupByBucket(records []db.Record) map[string][]db.Record {
+	grouped := map[string][]db.Record{}
+	for _, record := range records {
+		grouped[record.BucketUid] = append(grouped[record.BucketUid], record)
+	}
+
+	for uid := range grouped {
+		bucketRecords := grouped[uid]
+		sort.Slice(bucketRecords, func(i, j int) bool {
+			return bucketRecords[i].PeriodStart.Before(bucketRecords[j].PeriodStart)
+		})
+	}
+
+	return grouped
+}
+
+// Resample returns one sample every step from start to end (inclusive), skipping
+// steps where no record was in effect (bucket not yet metered or removed)
+func Resample(records []db.Record, start time.Time, end time.Time, step time.Duration, value ValueFunc) []Sample {
+	samples := []Sample{}
+	i := 0
+
+	for t := start; !t.After(end); t = t.Add(step) {
+		for i < len(records) && records[i].PeriodEnd != nil && !t.Before(*records[i].PeriodEnd) {
+			i++
+		}
+
+		if i >= len(records) {
+			break
+		}
+
+		if records[i].PeriodStart.After(t) {
+			continue
+		}
+
+		samples = append(samples, Sample{Time: t, Value: value(records[i])})
+	}
+
+	return samples
+}
+
+type Step struct {
+	Time         time.Time `json:"time"`
+	ObjectsCount uint64    `json:"objects_count"`
+	BytesTotal   uint64    `json:"bytes_count"`
+	ObjectsMin   uint64    `json:"objects_count_min"`
+	ObjectsMax   uint64    `json:"objects_count_max"`
+	ObjectsAvg   float64   `json:"objects_count_avg"`
+	BytesMin     uint64    `json:"bytes_count_min"`
+	BytesMax     uint64    `json:"bytes_count_max"`
+	BytesAvg     float64   `json:"bytes_count_avg"`
+	// part of the step falls in a gap without observations
+	Estimated bool `json:"estimated"`
+}
+
+type Series struct {
+	BucketUid string `json:"bucket_uid"`
+	Steps     []Step `json:"steps"`
+}
+
+// ResampleSteps returns a dense series per bucket with one step every step from start to end.
+// The step value is the one in effect at its start (or when metering began within it),
+// min/max/avg cover every record in effect during the step, avg is weighted by time.
+// Steps where no record was in effect are skipped.
+func ResampleSteps(records []db.Record, start time.Time, end time.Time, step time.Duration) []Series {
+	grouped := GroupByBucket(records)
+
+	uids := []string{}
+	for uid := range grouped {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	series := []Series{}
+	for _, uid := range uids {
+		bucketRecords := grouped[uid]
+		steps := []Step{}
+		i := 0
+
+		for t := start; t.Before(end); t = t.Add(step) {
+			stepEnd := t.Add(step)
+			if stepEnd.After(end) {
+				stepEnd = end
+			}
+
+			// skip records that ended before this step
+			for i < len(bucketRecords) && recordEnd(bucketRecords[i], end).Compare(t) <= 0 {
+				i++
+			}
+
+			var current *Step
+			var covered time.Duration
+			var bytesWeighted float64
+			var objectsWeighted float64
+
+			for j := i; j < len(bucketRecords) && bucketRecords[j].PeriodStart.Before(stepEnd); j++ {
+				record := bucketRecords[j]
+				from := maxTime(record.PeriodStart, t)
+				to := minTime(recordEnd(record, end), stepEnd)
+				if !from.Before(to) {
+					continue
+				}
+
+				if current == nil {
+					current = &Step{
+						Time:         t,
+						ObjectsCount: record.ObjectsCount,
+						BytesTotal:   record.BytesTotal,
+						ObjectsMin:   record.ObjectsCount,
+						ObjectsMax:   record.ObjectsCount,
+						BytesMin:     record.BytesTotal,
+						BytesMax:     record.BytesTotal,
+					}
+				}
+
+				current.Estimated = current.Estimated || record.Estimated
+				current.ObjectsMin = min(current.ObjectsMin, record.ObjectsCount)
+				current.ObjectsMax = max(current.ObjectsMax, record.ObjectsCount)
+				current.BytesMin = min(current.BytesMin, record.BytesTotal)
+				current.BytesMax = max(current.BytesMax, record.BytesTotal)
+
+				duration := to.Sub(from)
+				covered += duration
+				bytesWeighted += float64(record.BytesTotal) * duration.Seconds()
+				objectsWeighted += float64(record.ObjectsCount) * duration.Seconds()
+			}
+
+			if current == nil {
+				continue
+			}
+
+			current.BytesAvg = bytesWeighted / covered.Seconds()
+			current.ObjectsAvg = objectsWeighted / covered.Seconds()
+			steps = append(steps, *current)
+		}
+
+		if len(steps) > 0 {
+			series = append(series, Series{BucketUid: uid, Steps: steps})
+		}
+	}
+
+	return series
+}
+
+// open records are in effect until the end of the queried range
+func recordEnd(record db.Record, end time.Time) time.Time {
+	if record.PeriodEnd == nil {
+		return end
+	}
+
+	return *record.PeriodEnd
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,106 @@
+package usage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/pricing"
+)
+
+type Summary struct {
+	BucketUid string `json:"bucket_uid"`
+	// usage in effect at the end of the range
+	ObjectsCount uint64 `json:"objects_count"`
+	BytesTotal   uint64 `json:"bytes_count"`
+	// time weighted over the part of the range the bucket was metered
+	BytesAvg   float64 `json:"bytes_count_avg"`
+	BytesMax   uint64  `json:"bytes_count_max"`
+	ObjectsMax uint64  `json:"objects_count_max"`
+	GiBHours   float64 `json:"gib_hours"`
+	// 0 when pricing is not configured
+	Cost float64 `json:"cost"`
+}
+
+// Summarize totals the usage of each bucket between start and end
+func Summarize(records []db.Record, start time.Time, end time.Time) []Summary {
+	grouped := GroupByBucket(records)
+
+	uids := []string{}
+	for uid := range grouped {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	summaries := []Summary{}
+	for _, uid := range uids {
+		summary := Summary{BucketUid: uid}
+		var covered time.Duration
+		var bytesWeighted float64
+
+		for _, record := range grouped[uid] {
+			from := maxTime(record.PeriodStart, start)
+			to := minTime(recordEnd(record, end), end)
+			if !from.Before(to) {
+				continue
+			}
+
+			duration := to.Sub(from)
+			covered += duration
+			bytesWeighted += float64(record.BytesTotal) * duration.Seconds()
+
+			summary.ObjectsCount = record.ObjectsCount
+			summary.BytesTotal = record.BytesTotal
+			summary.BytesMax = max(summary.BytesMax, record.BytesTotal)
+			summary.ObjectsMax = max(summary.ObjectsMax, record.ObjectsCount)
+			summary.GiBHours += pricing.GiBHours(record.BytesTotal, duration)
+			summary.Cost += pricing.Cost(record.BytesTotal, duration)
+		}
+
+		if covered == 0 {
+			continue
+		}
+
+		summary.BytesAvg = bytesWeighted / covered.Seconds()
+		summaries = append(summaries, summary)
+	}
+
+	return summaries
+}
+
+// PeakBytes is the highest total size of all the buckets at any instant between start and end,
+// unlike the sum of each bucket's maximum which may never have been reached at once
+func PeakBytes(records []db.Record, start time.Time, end time.Time) uint64 {
+	type change struct {
+		at    time.Time
+		bytes int64
+	}
+
+	changes := []change{}
+	for _, record := range records {
+		from := maxTime(record.PeriodStart, start)
+		to := minTime(recordEnd(record, end), end)
+		if !from.Before(to) {
+			continue
+		}
+
+		changes = append(changes, change{from, int64(record.BytesTotal)}, change{to, -int64(record.BytesTotal)})
+	}
+
+	// records ending at an instant are removed before those starting at it are added
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].at.Equal(changes[j].at) {
+			return changes[i].bytes < changes[j].bytes
+		}
+		return changes[i].at.Before(changes[j].at)
+	})
+
+	var current int64
+	var peak int64
+	for _, c := range changes {
+		current += c.bytes
+		peak = max(peak, current)
+	}
+
+	return uint64(peak)
+}
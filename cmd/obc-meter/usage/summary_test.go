@@ -0,0 +1,52 @@
+package usage
+
+import (
+	"testing"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+)
+
+func TestPeakBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []db.Record
+		want    uint64
+	}{
+		{
+			name: "maxima at different times",
+			records: []db.Record{
+				{BucketUid: "a", PeriodStart: at(0), PeriodEnd: atPtr(10), BytesTotal: 100},
+				{BucketUid: "a", PeriodStart: at(10), BytesTotal: 10},
+				{BucketUid: "b", PeriodStart: at(0), PeriodEnd: atPtr(10), BytesTotal: 10},
+				{BucketUid: "b", PeriodStart: at(10), BytesTotal: 100},
+			},
+			want: 110,
+		},
+		{
+			name: "overlapping maxima",
+			records: []db.Record{
+				{BucketUid: "a", PeriodStart: at(0), BytesTotal: 100},
+				{BucketUid: "b", PeriodStart: at(5), PeriodEnd: atPtr(15), BytesTotal: 50},
+			},
+			want: 150,
+		},
+		{
+			name: "records outside the range",
+			records: []db.Record{
+				{BucketUid: "a", PeriodStart: at(-10), PeriodEnd: atPtr(0), BytesTotal: 1000},
+				{BucketUid: "b", PeriodStart: at(20), BytesTotal: 1000},
+				{BucketUid: "c", PeriodStart: at(0), BytesTotal: 1},
+			},
+			want: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := PeakBytes(test.records, at(0), at(20))
+			if got != test.want {
+				t.Errorf("PeakBytes() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
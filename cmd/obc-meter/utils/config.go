@@ -0,0 +1,492 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"sigs.k8s.io/yaml"
+)
+
+// The configuration is read from the YAML file named by CONFIG_FILE (config.yaml when it exists),
+// then every setting can be overridden by the environment variable in its env tag.
+//
+// Fields tagged secret are redacted when printed, fields tagged restart keep their startup value
+// when the file is reloaded.
+type Config struct {
+	AppEnv      string `json:"appEnv" env:"APP_ENV" restart:"true"`
+	Port        int    `json:"port" env:"PORT" restart:"true"`
+	PostgresUri string `json:"postgresUri" env:"POSTGRES_URI" restart:"true" secret:"true"`
+	// billing account of exports and source of webhook events
+	ClusterName string `json:"clusterName" env:"CLUSTER_NAME"`
+
+	Kubernetes KubernetesConfig `json:"kubernetes"`
+	Metering   MeteringConfig   `json:"metering"`
+	Pricing    PricingConfig    `json:"pricing"`
+	Anomalies  AnomaliesConfig  `json:"anomalies"`
+	Quotas     QuotasConfig     `json:"quotas"`
+	Budgets    BudgetsConfig    `json:"budgets"`
+	Webhooks   WebhooksConfig   `json:"webhooks"`
+}
+
+// only used when appEnv is development, in cluster credentials are used otherwise
+type KubernetesConfig struct {
+	ApiUrl   string `json:"apiUrl" env:"K8S_API_URL" restart:"true"`
+	ApiToken string `json:"apiToken" env:"K8S_API_TOKEN" restart:"true" secret:"true"`
+}
+
+type MeteringConfig struct {
+	// OBCs labelled <labelKey>=true are metered when no MeteringPolicy selects them
+	LabelKey        string   `json:"labelKey" env:"LABEL_KEY"`
+	AccountLabelKey string   `json:"accountLabelKey" env:"ACCOUNT_LABEL_KEY"`
+	PolicyName      string   `json:"policyName" env:"METERING_POLICY_NAME"`
+	Annotations     bool     `json:"annotations" env:"OBC_ANNOTATIONS"`
+	ReportResync    Duration `json:"reportResyncInterval" env:"REPORT_RESYNC_INTERVAL" restart:"true"`
+	// open records not verified by a measurement for this long are reported as stale, and
+	// observations further apart leave a gap where usage is estimated
+	StaleAfter Duration `json:"staleAfter" env:"STALE_AFTER"`
+	// how usage in gaps is reported by default: carry_forward, interpolate or exclude
+	Fill string `json:"fill" env:"GAP_FILL"`
+	// attempts per bucket and run for failures that may pass on retry (timeouts, throttling...),
+	// the wait between attempts starts at retryBackoff and doubles
+	RetryAttempts int      `json:"retryAttempts" env:"RETRY_ATTEMPTS"`
+	RetryBackoff  Duration `json:"retryBackoff" env:"RETRY_BACKOFF"`
+}
+
+type PricingConfig struct {
+	// pricing is disabled when unset
+	PricePerGiBMonth *float64 `json:"pricePerGiBMonth" env:"PRICE_PER_GIB_MONTH"`
+	Currency         string   `json:"currency" env:"PRICE_CURRENCY"`
+}
+
+type AnomaliesConfig struct {
+	ZScore     float64 `json:"zScore" env:"ANOMALY_Z_SCORE"`
+	MinBytes   uint64  `json:"minBytes" env:"ANOMALY_MIN_BYTES"`
+	MinObjects uint64  `json:"minObjects" env:"ANOMALY_MIN_OBJECTS"`
+	WebhookUrl string  `json:"webhookUrl" env:"ANOMALY_WEBHOOK_URL"`
+}
+
+type QuotasConfig struct {
+	// percentages of the quota
+	Thresholds []int `json:"thresholds" env:"QUOTA_THRESHOLDS"`
+}
+
+type BudgetsConfig struct {
+	WebhookUrl string `json:"webhookUrl" env:"BUDGET_WEBHOOK_URL"`
+}
+
+type WebhooksConfig struct {
+	Urls        []string `json:"urls" env:"WEBHOOK_URLS"`
+	Secret      string   `json:"secret" env:"WEBHOOK_SECRET" secret:"true"`
+	MaxAttempts int      `json:"maxAttempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+}
+
+// Duration accepts the same values as ParseDuration in YAML and environment variables
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return errors.New("durations must be strings such as 30s, 5m or 1d")
+	}
+
+	d.Duration, err = ParseDuration(s)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:        8080,
+		ClusterName: "obc-meter",
+		Metering: MeteringConfig{
+			LabelKey:        "meter-activated",
+			AccountLabelKey: "account",
+			PolicyName:      "default",
+			ReportResync:    Duration{time.Minute},
+			StaleAfter:      Duration{48 * time.Hour},
+			Fill:            db.FillCarryForward,
+			RetryAttempts:   3,
+			RetryBackoff:    Duration{2 * time.Second},
+		},
+		Pricing: PricingConfig{
+			Currency: "USD",
+		},
+		Anomalies: AnomaliesConfig{
+			ZScore:     3,
+			MinBytes:   1024 * 1024 * 1024,
+			MinObjects: 10000,
+		},
+		Quotas: QuotasConfig{
+			Thresholds: []int{80, 95, 100},
+		},
+		Webhooks: WebhooksConfig{
+			Urls:        []string{},
+			MaxAttempts: 5,
+		},
+	}
+}
+
+var config atomic.Pointer[Config]
+
+// GetConfig returns the configuration in effect, the defaults before it is loaded
+func GetConfig() *Config {
+	cfg := config.Load()
+	if cfg == nil {
+		defaults := defaultConfig()
+		return &defaults
+	}
+
+	return cfg
+}
+
+func getConfigFile() (string, bool) {
+	file := os.Getenv("CONFIG_FILE")
+	if file != "" {
+		return file, true
+	}
+
+	_, err := os.Stat("config.yaml")
+	return "config.yaml", err == nil
+}
+
+// LoadConfig reads the file and the environment, every invalid setting is reported at once
+func LoadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	file, ok := getConfigFile()
+	if ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		err = yaml.UnmarshalStrict(data, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file '%v': %v", file, err)
+		}
+	}
+
+	errs := applyEnv(reflect.ValueOf(&cfg).Elem())
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	slices.Sort(cfg.Quotas.Thresholds)
+
+	return &cfg, nil
+}
+
+func (cfg *Config) Validate() []error {
+	errs := []error{}
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.PostgresUri == "" {
+		invalid("postgresUri (POSTGRES_URI) is required")
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		invalid("port (PORT) must be between 1 and 65535, got %v", cfg.Port)
+	}
+
+	if cfg.AppEnv == "development" && (cfg.Kubernetes.ApiUrl == "" || cfg.Kubernetes.ApiToken == "") {
+		invalid("kubernetes.apiUrl (K8S_API_URL) and kubernetes.apiToken (K8S_API_TOKEN) are required during development")
+	}
+
+	if cfg.Metering.LabelKey == "" {
+		invalid("metering.labelKey (LABEL_KEY) can not be empty")
+	}
+
+	if cfg.Metering.ReportResync.Duration <= 0 {
+		invalid("metering.reportResyncInterval (REPORT_RESYNC_INTERVAL) must be positive")
+	}
+
+	if cfg.Metering.StaleAfter.Duration <= 0 {
+		invalid("metering.staleAfter (STALE_AFTER) must be positive")
+	}
+
+	if !slices.Contains(db.Fills, cfg.Metering.Fill) {
+		invalid("metering.fill (GAP_FILL) must be one of %v", strings.Join(db.Fills, ", "))
+	}
+
+	if cfg.Metering.RetryAttempts < 1 {
+		invalid("metering.retryAttempts (RETRY_ATTEMPTS) must be at least 1")
+	}
+
+	if cfg.Metering.RetryBackoff.Duration <= 0 {
+		invalid("metering.retryBackoff (RETRY_BACKOFF) must be positive")
+	}
+
+	if cfg.Pricing.PricePerGiBMonth != nil && *cfg.Pricing.PricePerGiBMonth < 0 {
+		invalid("pricing.pricePerGiBMonth (PRICE_PER_GIB_MONTH) can not be negative")
+	}
+
+	if cfg.Anomalies.ZScore <= 0 {
+		invalid("anomalies.zScore (ANOMALY_Z_SCORE) must be positive")
+	}
+
+	if len(cfg.Quotas.Thresholds) == 0 {
+		invalid("quotas.thresholds (QUOTA_THRESHOLDS) can not be empty")
+	}
+
+	for _, threshold := range cfg.Quotas.Thresholds {
+		if threshold <= 0 {
+			invalid("quotas.thresholds (QUOTA_THRESHOLDS) must be positive percentages, got %v", threshold)
+		}
+	}
+
+	if cfg.Webhooks.MaxAttempts < 1 {
+		invalid("webhooks.maxAttempts (WEBHOOK_MAX_ATTEMPTS) must be at least 1")
+	}
+
+	urls := map[string]string{
+		"anomalies.webhookUrl (ANOMALY_WEBHOOK_URL)": cfg.Anomalies.WebhookUrl,
+		"budgets.webhookUrl (BUDGET_WEBHOOK_URL)":    cfg.Budgets.WebhookUrl,
+	}
+	for i, webhookUrl := range cfg.Webhooks.Urls {
+		urls[fmt.Sprintf("webhooks.urls[%v] (WEBHOOK_URLS)", i)] = webhookUrl
+	}
+
+	for name, value := range urls {
+		if value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("%v must be an http(s) URL, got '%v'", name, value)
+		}
+	}
+
+	return errs
+}
+
+// applyEnv overrides the fields that have their env variable set
+func applyEnv(v reflect.Value) []error {
+	errs := []error{}
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+
+		env, ok := structField.Tag.Lookup("env")
+		if !ok {
+			if field.Kind() == reflect.Struct {
+				errs = append(errs, applyEnv(field)...)
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(env)
+		if !ok || raw == "" {
+			continue
+		}
+
+		err := setField(field, raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %v '%v': %v", env, raw, err))
+		}
+	}
+
+	return errs
+}
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == reflect.TypeOf(Duration{}) {
+		d, err := ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(Duration{d}))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return errors.New("expected an integer")
+		}
+		field.SetInt(int64(n))
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return errors.New("expected a positive integer")
+		}
+		field.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		field.SetFloat(f)
+	case reflect.Pointer:
+		value := reflect.New(field.Type().Elem())
+		err := setField(value.Elem(), raw)
+		if err != nil {
+			return err
+		}
+		field.Set(value)
+	case reflect.Slice:
+		// comma separated
+		items := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			item := reflect.New(field.Type().Elem()).Elem()
+			err := setField(item, part)
+			if err != nil {
+				return err
+			}
+			items = reflect.Append(items, item)
+		}
+		field.Set(items)
+	default:
+		return fmt.Errorf("unsupported setting type %v", field.Type())
+	}
+
+	return nil
+}
+
+// PrintConfig logs every effective setting with secrets redacted
+func PrintConfig(cfg *Config) {
+	file, ok := getConfigFile()
+	if ok {
+		log.Printf("Loaded configuration from '%v'\n", file)
+	}
+
+	printFields(reflect.ValueOf(cfg).Elem(), "")
+}
+
+func printFields(v reflect.Value, prefix string) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+		name := prefix + strings.Split(structField.Tag.Get("json"), ",")[0]
+
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(Duration{}) {
+			printFields(field, name+".")
+			continue
+		}
+
+		log.Printf("Running with %v=%v\n", name, formatField(field, structField.Tag.Get("secret") == "true"))
+	}
+}
+
+func formatField(field reflect.Value, secret bool) string {
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return "<unset>"
+		}
+		field = field.Elem()
+	}
+
+	if secret {
+		if field.String() == "" {
+			return "<unset>"
+		}
+
+		// keep the rest of URIs reviewable
+		u, err := url.Parse(field.String())
+		if err == nil && u.User != nil {
+			return u.Redacted()
+		}
+
+		return "<redacted>"
+	}
+
+	if d, ok := field.Interface().(Duration); ok {
+		return d.String()
+	}
+
+	return fmt.Sprint(field.Interface())
+}
+
+// how often the config file is checked for changes
+const configReloadInterval = 10 * time.Second
+
+// WatchConfig reloads the config file when it changes. Invalid files are ignored and
+// settings tagged restart keep their current value.
+func WatchConfig() {
+	file, ok := getConfigFile()
+	if !ok {
+		return
+	}
+
+	var lastModified time.Time
+	info, err := os.Stat(file)
+	if err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for {
+		time.Sleep(configReloadInterval)
+
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().After(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		cfg, err := LoadConfig()
+		if err != nil {
+			log.Printf("Ignoring changes to '%v', the configuration is invalid:\n%v\n", file, err)
+			continue
+		}
+
+		keepRestartFields(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(GetConfig()).Elem(), "")
+		config.Store(cfg)
+
+		log.Printf("Reloaded configuration from '%v'\n", file)
+		PrintConfig(cfg)
+	}
+}
+
+func keepRestartFields(next reflect.Value, current reflect.Value, prefix string) {
+	for i := 0; i < next.NumField(); i++ {
+		structField := next.Type().Field(i)
+		name := prefix + strings.Split(structField.Tag.Get("json"), ",")[0]
+
+		if structField.Tag.Get("restart") == "true" {
+			if !reflect.DeepEqual(next.Field(i).Interface(), current.Field(i).Interface()) {
+				log.Printf("Changing %v requires a restart, keeping the current value\n", name)
+				next.Field(i).Set(current.Field(i))
+			}
+			continue
+		}
+
+		if next.Field(i).Kind() == reflect.Struct && structField.Type != reflect.TypeOf(Duration{}) {
+			keepRestartFields(next.Field(i), current.Field(i), name+".")
+		}
+	}
+}
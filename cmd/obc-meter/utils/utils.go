@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
 	"github.com/joho/godotenv"
@@ -17,29 +19,50 @@ func loadEnvironment() {
 	}
 }
 
-func verifyEnvironment() {
-	requiredVars := [1]string{"POSTGRES_URI"}
-	optionalVars := [1]string{"LABEL_KEY"}
+// ConnectDatabase loads the configuration and connects to the database without migrating it
+func ConnectDatabase() {
+	loadEnvironment()
 
-	for i := 0; i < len(requiredVars); i++ {
-		if os.Getenv(requiredVars[i]) == "" {
-			log.Fatalf("ERROR: Missing environment variable %v\n", requiredVars[i])
-		}
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("ERROR: Invalid configuration:\n%v\n", err)
 	}
 
-	for i := 0; i < len(optionalVars); i++ {
-		key := optionalVars[i]
-		val := os.Getenv(key)
-		if val == "" {
-			fmt.Printf("Missing optional environment variable '%v'.\n", key)
-		} else {
-			fmt.Printf("Running with %v=%v \n", key, val)
-		}
-	}
+	config.Store(cfg)
+	PrintConfig(cfg)
+
+	db.ConnectPostgres(cfg.PostgresUri)
 }
 
 func StartupTasks() {
-	loadEnvironment()
-	verifyEnvironment()
-	db.ConnectPostgres()
+	ConnectDatabase()
+
+	err := db.MigrateUp()
+	if err != nil {
+		fmt.Println(err)
+		log.Fatal("Failed to migrate database")
+	}
+
+	go WatchConfig()
+}
+
+// ParseDuration accepts Go durations plus the 'd' (day) and 'w' (week) units, e.g. "1d" or "2w"
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, errors.New("invalid duration '" + s + "'")
+			}
+
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(s)
 }
@@ -0,0 +1,260 @@
+// Webhooks push CloudEvents (structured JSON mode) to every URL in WEBHOOK_URLS, and anomaly and
+// budget events to their own webhook URLs as well. Each delivery is stored in webhook_deliveries
+// and retried with exponential backoff until it succeeds or WEBHOOK_MAX_ATTEMPTS is reached.
+// Retries are driven from the table, so deliveries left pending by a restart are resumed.
+//
+// When WEBHOOK_SECRET is set, every request carries
+//
+//	X-Obc-Meter-Timestamp: <unix seconds>
+//	X-Obc-Meter-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// so receivers can verify the sender and reject stale requests.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fallmo/obc-meter/cmd/obc-meter/db"
+	"github.com/fallmo/obc-meter/cmd/obc-meter/utils"
+)
+
+const typePrefix = "io.github.fallmo.obc-meter."
+
+const (
+	TypeRunStarted    = typePrefix + "run.started"
+	TypeRunFinished   = typePrefix + "run.finished"
+	TypeRunFailed     = typePrefix + "run.failed"
+	TypeRunCancelled  = typePrefix + "run.cancelled"
+	TypeRunAbandoned  = typePrefix + "run.abandoned"
+	TypeRecordOpened  = typePrefix + "record.opened"
+	TypeRecordClosed  = typePrefix + "record.closed"
+	TypeBucketAdded   = typePrefix + "bucket.added"
+	TypeBucketRemoved = typePrefix + "bucket.removed"
+	TypeAnomaly       = typePrefix + "anomaly.detected"
+	TypeBudgetEvent   = typePrefix + "budget.threshold_reached"
+)
+
+var Types = []string{TypeRunStarted, TypeRunFinished, TypeRunFailed, TypeRunCancelled, TypeRunAbandoned, TypeRecordOpened, TypeRecordClosed, TypeBucketAdded, TypeBucketRemoved, TypeAnomaly, TypeBudgetEvent}
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// a delivery being attempted is claimed for this long, so a single process attempts it
+const claimDuration = time.Minute
+
+// pending deliveries are looked for this often
+const redeliveryInterval = 5 * time.Second
+
+// waited after the first failed attempt, doubled after each following one
+const firstBackoff = 2 * time.Second
+
+type Event struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data"`
+}
+
+func IsConfigured() bool {
+	return len(getUrls()) > 0
+}
+
+// Emit queues the event for every configured URL and the extra URLs, delivery happens in the
+// background
+func Emit(eventType string, subject string, data any, extraUrls ...string) {
+	urls := slices.Clone(getUrls())
+	for _, url := range extraUrls {
+		if url != "" && !slices.Contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+
+	if len(urls) == 0 {
+		return
+	}
+
+	id, err := newEventId()
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to emit '%v' event\n", eventType)
+		return
+	}
+
+	payload, err := json.Marshal(Event{
+		SpecVersion:     "1.0",
+		ID:              id,
+		Source:          getSource(),
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+	if err != nil {
+		fmt.Println(err)
+		log.Printf("Failed to emit '%v' event\n", eventType)
+		return
+	}
+
+	for _, url := range urls {
+		delivery, err := db.InsertWebhookDelivery(db.WebhookDelivery{
+			EventId:   id,
+			EventType: eventType,
+			Url:       url,
+			Payload:   payload,
+		}, time.Now().Add(claimDuration))
+		if err != nil {
+			log.Printf("Failed to queue '%v' event for '%v'\n", eventType, url)
+			continue
+		}
+
+		go deliver(*delivery)
+	}
+}
+
+// Replay sends a stored delivery's event again as a new delivery to the same URL
+func Replay(original db.WebhookDelivery) (*db.WebhookDelivery, error) {
+	delivery, err := db.InsertWebhookDelivery(db.WebhookDelivery{
+		EventId:   original.EventId,
+		EventType: original.EventType,
+		Url:       original.Url,
+		Payload:   original.Payload,
+		ReplayOf:  &original.ID,
+	}, time.Now().Add(claimDuration))
+	if err != nil {
+		return nil, err
+	}
+
+	go deliver(*delivery)
+
+	return delivery, nil
+}
+
+// StartRedelivery attempts the pending deliveries whose backoff has elapsed, including those
+// left pending by a restart of this or another process
+func StartRedelivery() {
+	for {
+		redeliver()
+		time.Sleep(redeliveryInterval)
+	}
+}
+
+func redeliver() {
+	deliveries, err := db.ClaimPendingWebhookDeliveries(100, time.Now().Add(claimDuration))
+	if err != nil {
+		log.Println("Failed to retrieve pending webhook deliveries")
+		return
+	}
+
+	for _, delivery := range deliveries {
+		go deliver(delivery)
+	}
+}
+
+// deliver makes one attempt of a claimed delivery, leaving it pending until its next attempt
+// when it fails with attempts left
+func deliver(delivery db.WebhookDelivery) {
+	maxAttempts := getMaxAttempts()
+	attempt := delivery.Attempts + 1
+
+	responseStatus, err := send(delivery.Url, delivery.Payload)
+
+	args := db.RecordWebhookAttemptArgs{Status: StatusDelivered, ResponseStatus: responseStatus}
+	if err != nil {
+		message := err.Error()
+		args.LastError = &message
+		args.Status = StatusFailed
+
+		if attempt < maxAttempts {
+			next := time.Now().Add(firstBackoff << (attempt - 1))
+			args.Status = StatusPending
+			args.NextAttemptAt = &next
+		}
+	}
+
+	dbErr := db.RecordWebhookAttempt(delivery.ID, args)
+	if dbErr != nil {
+		log.Printf("Failed to record attempt of webhook delivery '%v'\n", delivery.ID)
+	}
+
+	if err != nil {
+		log.Printf("Webhook delivery '%v' to '%v' failed (attempt %v/%v): %v\n", delivery.ID, delivery.Url, attempt, maxAttempts, err)
+	}
+}
+
+func send(url string, payload []byte) (*int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+
+	secret := utils.GetConfig().Webhooks.Secret
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Obc-Meter-Timestamp", timestamp)
+		req.Header.Set("X-Obc-Meter-Signature", "sha256="+Sign(secret, timestamp, payload))
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return &res.StatusCode, fmt.Errorf("webhook responded with status %v", res.Status)
+	}
+
+	return &res.StatusCode, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>"
+func Sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEventId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+func getUrls() []string {
+	return utils.GetConfig().Webhooks.Urls
+}
+
+func getSource() string {
+	return "/obc-meter/" + utils.GetConfig().ClusterName
+}
+
+func getMaxAttempts() int {
+	return utils.GetConfig().Webhooks.MaxAttempts
+}